@@ -29,11 +29,14 @@ export V3_LIMIT=200
 # export V3_LIMIT=20
 # export V3_OFFSET=0
 # export V3_SQL_PATH='./sql/'
+# export V3_LOADER=upsert
+# export V3_SCHEMA_POLICY=add
 # export V3_CALC_WEEK_DAILY=1
 # export V3_CALC_MONTH_DAILY=1
 # export V3_CALC_QUARTER_DAILY=1
 # export V3_CALC_YEAR_DAILY=1
 # export V3_CALC_YEAR2_DAILY=1
+# export V3_TZ=Europe/Warsaw
 # export V3_DATE_FROM=2023-10-01
 # export V3_DATE_TO=2023-11-01
 # export V3_FORCE_CALC=1
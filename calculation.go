@@ -0,0 +1,904 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Prefix - prefix used by all environment variables that configure calculations
+	Prefix = "V3_"
+	// SkippedExitCode - exit code used by calcmetric to mark that calculations were not needed
+	SkippedExitCode  = 66
+	gMaxPlaceholders = 0x8000
+)
+
+var (
+	gRequired = []string{
+		"CONN",
+		"METRIC",
+		"TABLE",
+		"PROJECT_SLUG",
+		"TIME_RANGE",
+	}
+)
+
+// Calculation - describes a single metric calculation for a project slug and a time range
+// Each field maps to a V3_ environment variable described in README.md
+type Calculation struct {
+	Metric           string            // V3_METRIC - metric SQL file name without the .sql extension
+	Table            string            // V3_TABLE
+	ProjectSlug      string            // V3_PROJECT_SLUG
+	TimeRange        string            // V3_TIME_RANGE
+	DateFrom         string            // V3_DATE_FROM - required for "c" time range
+	DateTo           string            // V3_DATE_TO - required for "c" time range
+	TimeZone         string            // V3_TZ - IANA time zone name used for time ranges computation, local time zone if not specified
+	WeekStart        string            // V3_WEEK_START - first day of week (for example sunday), monday if not specified
+	FiscalYearStart  string            // V3_FISCAL_YEAR_START - first month of fiscal year (for example 7 or july), january if not specified
+	SQLPath          string            // V3_SQL_PATH - "./sql/" if not specified
+	Limit            string            // V3_LIMIT - replaces {{limit}}
+	Offset           string            // V3_OFFSET - replaces {{offset}}
+	Params           map[string]string // V3_PARAM_xyz - with "PARAM_" prefix skipped in keys
+	IndexedColumns   []string          // V3_INDEXED_COLUMNS
+	PrimaryKey       []string          // V3_PRIMARY_KEY - columns identifying a row within a calculated window, unique index is created on them
+	ColumnTypes      map[string]string // V3_COLUMN_TYPES - column name to result table type overrides, for example "memberid:uuid,tags:text[]"
+	Delete           string            // V3_DELETE - comma separated list of: tr,ps,df,dt
+	Loader           string            // V3_LOADER - LoaderCopy (default) or LoaderUpsert
+	SchemaPolicy     string            // V3_SCHEMA_POLICY - SchemaRefuse (default), SchemaAdd or SchemaWiden
+	Bucket           string            // V3_BUCKET - BucketDay, BucketWeek or BucketMonth, enables time-series mode, replaces {{bucket}}
+	Timeout          time.Duration     // V3_TIMEOUT - deadline for the whole calculation, for example 30m, no deadline if not specified
+	StatementTimeout time.Duration     // V3_STATEMENT_TIMEOUT - Postgres statement_timeout for metric SQL and loading rows, for example 10m
+	Slice            string            // V3_SLICE - SliceDay, SliceWeek, SliceMonth, SliceQuarter or SliceYear, calculate additive metric in concurrent slices
+	SliceThreads     int               // V3_SLICE_THREADS - number of slices calculated concurrently, number of CPUs if not specified
+	WindowLockWait   time.Duration     // V3_WINDOW_LOCK_WAIT - wait up to this time when the same window is being calculated by another run, skip if not specified
+	Cleanup          bool              // V3_CLEANUP
+	Drop             bool              // V3_DROP
+	ForceCalc        bool              // V3_FORCE_CALC
+	PPT              bool              // V3_PPT
+	GuessType        bool              // V3_GUESS_TYPE
+	CalcWeekDaily    bool              // V3_CALC_WEEK_DAILY
+	CalcMonthDaily   bool              // V3_CALC_MONTH_DAILY
+	CalcQuarterDaily bool              // V3_CALC_QUARTER_DAILY
+	CalcYearDaily    bool              // V3_CALC_YEAR_DAILY
+	CalcYear2Daily   bool              // V3_CALC_YEAR2_DAILY
+	Debug            bool              // V3_DEBUG
+}
+
+// Result - outcome of a single Run call
+type Result struct {
+	Table      string        // final table name (can have project slug suffix when PPT is used)
+	TimeZone   string        // time zone used for time range computation
+	DateFrom   time.Time     // calculated time range start
+	DateTo     time.Time     // calculated time range end
+	Fiscal     bool          // true if time range was computed using fiscal year boundaries different from calendar ones
+	Calculated bool          // true if any rows were written, false means calculation was not needed or produced no data
+	Locked     bool          // true if calculation was skipped because the same window was being calculated by another run
+	Rows       int           // number of rows written
+	Batches    int           // number of insert batches executed (upsert loader only)
+	Loader     string        // loader used to save rows
+	QueryTime  time.Duration // time until metric SQL started returning rows
+	LoadTime   time.Duration // time spent fetching and saving rows
+	Duration   time.Duration // how long did Run take
+}
+
+// EnvMap - returns all environment variables starting with prefix, with that prefix skipped in keys
+func EnvMap(prefix string) map[string]string {
+	env := make(map[string]string)
+	prefixLen := len(prefix)
+	for _, pair := range os.Environ() {
+		if strings.HasPrefix(pair, prefix) {
+			ary := strings.Split(pair, "=")
+			if len(ary) < 2 {
+				continue
+			}
+			key := ary[0]
+			val := strings.Join(ary[1:], "=")
+			env[key[prefixLen:]] = val
+		}
+	}
+	return env
+}
+
+// CalculationFromEnv - creates calculation from environment map (keys without the V3_ prefix)
+// It doesn't check for V3_CONN, because connection is handled by the caller
+func CalculationFromEnv(env map[string]string) (Calculation, error) {
+	c := Calculation{Params: make(map[string]string)}
+	for _, key := range gRequired {
+		if key == "CONN" {
+			continue
+		}
+		_, ok := env[key]
+		if !ok {
+			return c, fmt.Errorf("you must define %s%s environment variable to run this", Prefix, key)
+		}
+	}
+	c.Metric = env["METRIC"]
+	c.Table = env["TABLE"]
+	c.ProjectSlug = env["PROJECT_SLUG"]
+	c.TimeRange = env["TIME_RANGE"]
+	c.DateFrom = env["DATE_FROM"]
+	c.DateTo = env["DATE_TO"]
+	c.TimeZone = env["TZ"]
+	c.WeekStart = env["WEEK_START"]
+	c.FiscalYearStart = env["FISCAL_YEAR_START"]
+	c.SQLPath = env["SQL_PATH"]
+	c.Limit = env["LIMIT"]
+	c.Offset = env["OFFSET"]
+	c.Delete = env["DELETE"]
+	c.Loader = env["LOADER"]
+	c.SchemaPolicy = env["SCHEMA_POLICY"]
+	c.Bucket = env["BUCKET"]
+	c.Slice = env["SLICE"]
+	durations := map[string]*time.Duration{
+		"TIMEOUT":           &c.Timeout,
+		"STATEMENT_TIMEOUT": &c.StatementTimeout,
+		"WINDOW_LOCK_WAIT":  &c.WindowLockWait,
+	}
+	for k, p := range durations {
+		v, ok := env[k]
+		if !ok || v == "" {
+			continue
+		}
+		var err error
+		*p, err = time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s%s '%s': %+v", Prefix, k, v, err)
+		}
+	}
+	sliceThreads, ok := env["SLICE_THREADS"]
+	if ok && sliceThreads != "" {
+		var err error
+		c.SliceThreads, err = strconv.Atoi(sliceThreads)
+		if err != nil {
+			return c, fmt.Errorf("invalid %sSLICE_THREADS '%s': %+v", Prefix, sliceThreads, err)
+		}
+	}
+	c.Cleanup = env["CLEANUP"] != ""
+	indices, ok := env["INDEXED_COLUMNS"]
+	if ok && indices != "" {
+		c.IndexedColumns = strings.Split(indices, ",")
+	}
+	pk, ok := env["PRIMARY_KEY"]
+	if ok && pk != "" {
+		c.PrimaryKey = strings.Split(pk, ",")
+	}
+	types, ok := env["COLUMN_TYPES"]
+	if ok && types != "" {
+		var err error
+		c.ColumnTypes, err = parseColumnTypes(types)
+		if err != nil {
+			return c, err
+		}
+	}
+	for k, v := range env {
+		if strings.HasPrefix(k, "PARAM_") {
+			c.Params[k[6:]] = v
+		}
+	}
+	flags := map[string]*bool{
+		"DROP":               &c.Drop,
+		"FORCE_CALC":         &c.ForceCalc,
+		"PPT":                &c.PPT,
+		"GUESS_TYPE":         &c.GuessType,
+		"CALC_WEEK_DAILY":    &c.CalcWeekDaily,
+		"CALC_MONTH_DAILY":   &c.CalcMonthDaily,
+		"CALC_QUARTER_DAILY": &c.CalcQuarterDaily,
+		"CALC_YEAR_DAILY":    &c.CalcYearDaily,
+		"CALC_YEAR2_DAILY":   &c.CalcYear2Daily,
+		"DEBUG":              &c.Debug,
+	}
+	for k, p := range flags {
+		_, *p = env[k]
+	}
+	return c, nil
+}
+
+// location - returns time zone to compute time ranges in
+func (c *Calculation) location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %sTZ '%s': %+v", Prefix, c.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// zoneName - returns name of time zone loc recorded in results, for the local time zone it is its IANA name
+// (from TZ environment variable or /etc/localtime link) or its abbreviation at dt if the IANA name is unknown
+func zoneName(loc *time.Location, dt time.Time) string {
+	if loc != time.Local {
+		return loc.String()
+	}
+	tz, ok := os.LookupEnv("TZ")
+	if ok {
+		tz = strings.TrimPrefix(tz, ":")
+		if tz == "" {
+			return "UTC"
+		}
+		if !filepath.IsAbs(tz) {
+			return tz
+		}
+	}
+	link, err := filepath.EvalSymlinks("/etc/localtime")
+	if err == nil {
+		i := strings.Index(link, "zoneinfo/")
+		if i >= 0 {
+			return link[i+len("zoneinfo/"):]
+		}
+	}
+	name, _ := dt.In(loc).Zone()
+	return name
+}
+
+// weekStart - returns first day of week used for week based time ranges
+// Full day names and their 3 letter abbreviations are accepted, case insensitive
+func (c *Calculation) weekStart() (time.Weekday, error) {
+	name := strings.ToLower(strings.TrimSpace(c.WeekStart))
+	if name == "" {
+		return time.Monday, nil
+	}
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		day := strings.ToLower(wd.String())
+		if name == day || name == day[:3] {
+			return wd, nil
+		}
+	}
+	return time.Monday, fmt.Errorf("invalid %sWEEK_START '%s', expected week day name, for example: sunday, mon", Prefix, c.WeekStart)
+}
+
+// fiscalYearStart - returns first month of fiscal year used for quarter and year based time ranges
+// Month numbers (1-12), full month names and their 3 letter abbreviations are accepted, case insensitive
+func (c *Calculation) fiscalYearStart() (time.Month, error) {
+	name := strings.ToLower(strings.TrimSpace(c.FiscalYearStart))
+	if name == "" {
+		return time.January, nil
+	}
+	for m := time.January; m <= time.December; m++ {
+		month := strings.ToLower(m.String())
+		if name == month || name == month[:3] || name == strconv.Itoa(int(m)) {
+			return m, nil
+		}
+	}
+	return time.January, fmt.Errorf("invalid %sFISCAL_YEAR_START '%s', expected month number or name, for example: 7, july", Prefix, c.FiscalYearStart)
+}
+
+// calendar - returns week and year boundaries to compute time ranges with
+func (c *Calculation) calendar() (calendar, error) {
+	weekStart, err := c.weekStart()
+	if err != nil {
+		return calendar{}, err
+	}
+	yearStart, err := c.fiscalYearStart()
+	if err != nil {
+		return calendar{}, err
+	}
+	return calendar{weekStart: weekStart, yearStart: yearStart}, nil
+}
+
+func toDBIdentifier(arg string) string {
+	return strings.Replace(strings.ToLower(arg), "-", "_", -1)
+}
+
+// isCalculated - returns true if table has rows for c's window, fiscal and calendar windows are different windows
+// (rows saved before fiscal column was added are calendar ones)
+func isCalculated(ctx context.Context, db *sql.DB, table string, c *Calculation, dtf, dtt time.Time, fiscal bool) (bool, error) {
+	dtf = DayStart(dtf)
+	// dtt = NextDayStart(dtt)
+	dtt = DayStart(dtt)
+	sqlQuery := fmt.Sprintf(
+		`select last_calculated_at from "%s" where project_slug = $1 and time_range = $2 and date_from = $3 and date_to = $4 and coalesce(fiscal, false) = $5`,
+		table,
+	)
+	args := []interface{}{c.ProjectSlug, c.TimeRange, dtf, dtt, fiscal}
+	if c.Debug {
+		Logf("executing sql: %s\nwith args: %+v\n", sqlQuery, args)
+	}
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		switch e := err.(type) {
+		case *pq.Error:
+			errName := e.Code.Name()
+			if errName == "undefined_table" {
+				Logf("table '%s' does not exist yet, so we need to calculate this metric.\n", table)
+				return false, nil
+			}
+			if errName == "undefined_column" {
+				Logf("table '%s' has no fiscal column yet (it is added by the calculation), so we need to calculate this metric.\n", table)
+				return false, nil
+			}
+			QueryOut(sqlQuery, args...)
+			return false, err
+		default:
+			QueryOut(sqlQuery, args...)
+			return false, err
+		}
+	}
+	defer func() { _ = rows.Close() }()
+	var (
+		lastCalc time.Time
+		fetched  bool
+	)
+	for rows.Next() {
+		err := rows.Scan(&lastCalc)
+		if err != nil {
+			return false, err
+		}
+		fetched = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return false, err
+	}
+	if fetched {
+		Logf("table '%s' was last computed at %+v for (%s, %s, %+v, %+v), so calculation is not needed\n", table, lastCalc, c.ProjectSlug, c.TimeRange, dtf, dtt)
+		return true, nil
+	}
+	Logf("table '%s' present, but it needs calculation for (%s, %s, %+v, %+v)\n", table, c.ProjectSlug, c.TimeRange, dtf, dtt)
+	return false, nil
+}
+
+// supportCleanup - deletes previous windows of c's time range and project slug, only fiscal or only calendar ones,
+// so fiscal and calendar calculations writing the same time range into the same table don't delete each other's rows
+func supportCleanup(ctx context.Context, db *sql.DB, table string, c *Calculation, dtf, dtt time.Time, fiscal bool) {
+	if !c.Cleanup {
+		return
+	}
+	dtf = DayStart(dtf)
+	dtt = DayStart(dtt)
+	delQuery := fmt.Sprintf(
+		`delete from "%s" where time_range = $1 and project_slug = $2 and date_from < $3 and date_to < $4 and coalesce(fiscal, false) = $5 and date(last_calculated_at) < date(now())`,
+		table,
+	)
+	args := []interface{}{c.TimeRange, c.ProjectSlug, dtf, dtt, fiscal}
+	if c.Debug {
+		Logf("cleanup: delete from table:\n%s\n%+v\n", delQuery, args)
+	}
+	res, err := db.ExecContext(ctx, delQuery, args...)
+	if err != nil {
+		Logf("error: %+v\n", err)
+		QueryOut(delQuery, args...)
+		return
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows > 0 {
+		Logf("cleanup %d rows from \"%s\"(%s, %s, <%+v, <%+v)\n", rows, table, c.ProjectSlug, c.TimeRange, dtf, dtt)
+	}
+	return
+}
+
+func supportDelete(ctx context.Context, db *sql.DB, table string, c *Calculation, dtf, dtt time.Time) bool {
+	if c.Delete == "" {
+		return false
+	}
+	delAry := strings.Split(c.Delete, ",")
+	delMap := make(map[string]struct{})
+	for _, k := range delAry {
+		delMap[k] = struct{}{}
+	}
+	if len(delMap) <= 0 {
+		Logf("unconditioned DELETE is not suppored - you probably mean something else, use DROP to do a full table delete instead\n")
+		return false
+	}
+	args := []interface{}{}
+	delQuery := fmt.Sprintf(`delete from "%s"`, table)
+	// tr,ps,df,dt
+	conds := []string{}
+	cond := ""
+	i := 0
+	_, tr := delMap["tr"]
+	if tr {
+		i++
+		conds = append(conds, fmt.Sprintf("time_range = $%d", i))
+		args = append(args, c.TimeRange)
+	}
+	_, ps := delMap["ps"]
+	if ps {
+		i++
+		conds = append(conds, fmt.Sprintf("project_slug = $%d", i))
+		args = append(args, c.ProjectSlug)
+	}
+	_, df := delMap["df"]
+	if df {
+		i++
+		conds = append(conds, fmt.Sprintf("date_from = $%d", i))
+		args = append(args, dtf)
+	}
+	_, dt := delMap["dt"]
+	if dt {
+		i++
+		conds = append(conds, fmt.Sprintf("date_to = $%d", i))
+		args = append(args, dtt)
+	}
+	if len(conds) > 0 {
+		cond = strings.Join(conds, " and ")
+		delQuery += " where " + cond
+	}
+	if c.Debug {
+		Logf("delete from table:\n%s\n%+v\n", delQuery, args)
+	}
+	res, err := db.ExecContext(ctx, delQuery, args...)
+	if err != nil {
+		Logf("error: %+v\n", err)
+		QueryOut(delQuery, args...)
+		return false
+	}
+	rows, err := res.RowsAffected()
+	if err == nil {
+		return rows > 0
+	}
+	return false
+}
+
+func calculate(ctx context.Context, db *sql.DB, sqlQuery, table string, dtf, dtt time.Time, c *Calculation, res *Result) error {
+	debug := c.Debug
+	dtQuery := time.Now()
+	var rows *sql.Rows
+	if c.TimeZone != "" || c.StatementTimeout > 0 {
+		// Run metric SQL with the session time zone set, so dates are compared with timestamps in that zone
+		// and with statement timeout set
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+		err = setSession(ctx, tx, c, res, true)
+		if err != nil {
+			return err
+		}
+		rows, err = tx.QueryContext(ctx, sqlQuery)
+		if err != nil {
+			QueryOut(sqlQuery, []interface{}{}...)
+			return err
+		}
+	} else {
+		var err error
+		rows, err = db.QueryContext(ctx, sqlQuery)
+		if err != nil {
+			QueryOut(sqlQuery, []interface{}{}...)
+			return err
+		}
+	}
+	defer func() { _ = rows.Close() }()
+	res.QueryTime = time.Now().Sub(dtQuery)
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	if debug {
+		Logf("columns: %d\n", len(columns))
+		for _, column := range columns {
+			Logf("%+v\n", column)
+		}
+	}
+	indicesAry := c.IndexedColumns
+	if debug && len(indicesAry) > 0 {
+		Logf("extra indices requested: %+v\n", indicesAry)
+	}
+	names := []string{}
+	for _, column := range columns {
+		names = append(names, column.Name())
+	}
+	err = checkColumnNames(c.Metric, names)
+	if err != nil {
+		return err
+	}
+	if c.Bucket != "" {
+		found := false
+		for _, column := range columns {
+			if strings.ToLower(column.Name()) == gBucketColumn {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("metric '%s' must return '%s' column when %sBUCKET is set", c.Metric, gBucketColumn, Prefix)
+		}
+	}
+	createTable := fmt.Sprintf(`create table if not exists "%s"(
+  time_range varchar(%d) not null,
+  project_slug text not null,
+  last_calculated_at timestamp not null,
+  date_from date not null,
+  date_to date not null,
+  row_number int not null,
+`,
+		table,
+		gMaxTimeRangeLen,
+	)
+	for _, col := range gBuiltinColumns {
+		createTable += fmt.Sprintf("  %s %s,\n", col.name, col.ddl)
+	}
+	l := len(columns) - 1
+	colNames := []string{}
+	colTypes := []string{}
+	namesMap := make(map[string]struct{})
+	for i, column := range columns {
+		tp, err := dbTypeName(column, c.ColumnTypes, c.GuessType)
+		if err != nil {
+			return err
+		}
+		colName := column.Name()
+		_, ok := namesMap[colName]
+		if ok {
+			return fmt.Errorf("non unique column name '%s'", colName)
+		}
+		namesMap[colName] = struct{}{}
+		colNames = append(colNames, colName)
+		colTypes = append(colTypes, tp)
+		createTable += fmt.Sprintf(`  %s %s`, colName, tp)
+		nullable, ok := column.Nullable()
+		if ok && !nullable {
+			createTable += ` not null`
+		}
+		if i < l {
+			createTable += ",\n"
+		} else {
+			createTable += fmt.Sprintf(`,
+  primary key(%s)
+);
+`,
+				strings.Join(primaryKey(c), ", "),
+			)
+		}
+	}
+	// Tables created by older versions don't have all built-in columns yet
+	for _, col := range gBuiltinColumns {
+		createTable += fmt.Sprintf("alter table \"%s\" add column if not exists %s %s;\n", table, col.name, col.ddl)
+	}
+	// Tables created by older versions have time_range varchar(6), too short for time range expressions
+	createTable += fmt.Sprintf(`do $$ begin
+  if (select character_maximum_length from information_schema.columns where table_schema = current_schema() and table_name = %s and column_name = 'time_range') < %d then
+    alter table "%s" alter column time_range type varchar(%d);
+  end if;
+end $$;
+`,
+		pq.QuoteLiteral(table),
+		gMaxTimeRangeLen,
+		table,
+		gMaxTimeRangeLen,
+	)
+	createTable += fmt.Sprintf(`create index if not exists "%s_time_range_idx" on "%s"(time_range);
+`,
+		table,
+		table,
+	)
+	if !c.PPT {
+		createTable += fmt.Sprintf(`create index if not exists "%s_project_slug_idx" on "%s"(project_slug);
+`,
+			table,
+			table,
+		)
+	}
+	if c.Bucket != "" {
+		createTable += fmt.Sprintf(`create index if not exists "%s_%s_idx" on "%s"(%s);
+`,
+			table,
+			gBucketColumn,
+			table,
+			gBucketColumn,
+		)
+	}
+	if len(c.PrimaryKey) > 0 {
+		// Rows of time-series tables are identified within their bucket
+		pk := primaryKey(c)
+		pk = pk[:len(pk)-1]
+		for _, col := range c.PrimaryKey {
+			if col != gBucketColumn {
+				pk = append(pk, col)
+			}
+		}
+		createTable += fmt.Sprintf(`create unique index if not exists "%s_pk_idx" on "%s"(%s);
+`,
+			table,
+			table,
+			strings.Join(pk, ", "),
+		)
+	}
+	for _, index := range indicesAry {
+		createTable += fmt.Sprintf(`create index if not exists "%s_%s_idx" on "%s"(%s);
+`,
+			table,
+			index,
+			table,
+			index,
+		)
+	}
+	err = evolveSchema(ctx, db, table, colNames, colTypes, c)
+	if err != nil {
+		return err
+	}
+	if debug {
+		Logf("create table:\n%s\n", createTable)
+	}
+	_, err = db.ExecContext(ctx, createTable)
+	if err != nil {
+		QueryOut(createTable, []interface{}{}...)
+		return err
+	}
+	loader := c.Loader
+	if loader == "" {
+		loader = LoaderCopy
+	}
+	res.Loader = loader
+	dtLoad := time.Now()
+	switch loader {
+	case LoaderCopy:
+		err = loadCopy(ctx, db, rows, table, colNames, dtf, dtt, c, res)
+	case LoaderUpsert:
+		err = loadUpsert(ctx, db, rows, table, colNames, dtf, dtt, c, res)
+	default:
+		err = fmt.Errorf("unknown loader: '%s', allowed: %s, %s", loader, LoaderCopy, LoaderUpsert)
+	}
+	if err != nil {
+		return err
+	}
+	res.LoadTime = time.Now().Sub(dtLoad)
+	Logf("loaded %d rows into '%s' using %s loader, query took %v, load took %v\n", res.Rows, table, loader, res.QueryTime, res.LoadTime)
+	return nil
+}
+
+func needsCalculation(ctx context.Context, db *sql.DB, table string, c *Calculation, now time.Time) (bool, time.Time, time.Time, error) {
+	var tm time.Time
+	fiscal := isFiscalRange(c, now)
+	if c.TimeRange != "c" {
+		dtf, dtt, err := currentTimeRange(c, now)
+		if err != nil {
+			return true, tm, tm, err
+		}
+		isCalc, err := isCalculated(ctx, db, table, c, dtf, dtt, fiscal)
+		if err != nil {
+			return true, dtf, dtt, err
+		}
+		return !isCalc, dtf, dtt, nil
+	}
+	if c.DateFrom == "" {
+		return true, tm, tm, fmt.Errorf("you must specify %sDATE_FROM when using %sTIME_RANGE=c", Prefix, Prefix)
+	}
+	if c.DateTo == "" {
+		return true, tm, tm, fmt.Errorf("you must specify %sDATE_TO when using %sTIME_RANGE=c", Prefix, Prefix)
+	}
+	dtf, err := TimeParseAny(c.DateFrom)
+	if err != nil {
+		return true, tm, tm, err
+	}
+	dtt, err := TimeParseAny(c.DateTo)
+	if err != nil {
+		return true, dtf, tm, err
+	}
+	dtf = DayStart(dtf)
+	dtt = DayStart(dtt)
+	isCalc, err := isCalculated(ctx, db, table, c, dtf, dtt, fiscal)
+	if err != nil {
+		return true, dtf, dtt, err
+	}
+	return !isCalc, dtf, dtt, nil
+}
+
+// IsCalculated - returns true if c's result table already has rows for c's project slug and time range
+// calculated for dtf - dtt window, it doesn't read metric SQL
+func IsCalculated(ctx context.Context, db *sql.DB, c Calculation, dtf, dtt time.Time) (bool, error) {
+	table := c.Table
+	if c.PPT {
+		table += "_" + toDBIdentifier(c.ProjectSlug)
+	}
+	return isCalculated(ctx, db, table, &c, dtf, dtt, isFiscalRange(&c, time.Now()))
+}
+
+// Run - calculates metric described by c (if needed) and saves its results into c.Table
+// Result.Calculated is false when calculation was not needed or didn't write any rows
+// Errors caused by V3_TIMEOUT deadline, ctx deadline or V3_STATEMENT_TIMEOUT wrap ErrTimeout, see IsTimeout
+// Unlike the original calcmetric, metric SQL file is read and validated (front-matter, params, placeholders, column
+// types) before checking if calculation is needed: front-matter can change the time range (week_start,
+// fiscal_year_start, time_ranges) and invalid metrics must fail before touching the database, so a missing or broken
+// metric SQL file fails even when its time range is already calculated
+func Run(ctx context.Context, db *sql.DB, c Calculation) (res Result, err error) {
+	dtStart := time.Now()
+	res.Table = c.Table
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		res.Duration = time.Now().Sub(dtStart)
+		err = timeoutError(ctx, err, &c)
+	}()
+	debug := c.Debug
+	table := c.Table
+	loc, err := c.location()
+	if err != nil {
+		return res, err
+	}
+	now := time.Now().In(loc)
+	res.TimeZone = zoneName(loc, now)
+	path := c.SQLPath
+	if path == "" {
+		path = "./sql/"
+	}
+	fn := path + c.Metric + ".sql"
+	contents, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return res, err
+	}
+	hdr, tmpl, err := parseMetricHeader(string(contents))
+	if err != nil {
+		return res, err
+	}
+	// Params explicitly passed by the caller, applyMetricHeader adds front-matter defaults to c.Params
+	explicit := c.Params
+	err = applyMetricHeader(&hdr, &c)
+	if err != nil {
+		return res, err
+	}
+	values := map[string]string{
+		"project_slug": c.ProjectSlug,
+	}
+	if c.Limit != "" {
+		values["limit"] = c.Limit
+	}
+	if c.Offset != "" {
+		values["offset"] = c.Offset
+	}
+	if c.TimeZone != "" {
+		values["timezone"] = loc.String()
+	}
+	err = checkBucket(c.Bucket)
+	if err != nil {
+		return res, err
+	}
+	if c.Bucket != "" {
+		values["bucket"] = c.Bucket
+	}
+	for n, v := range c.Params {
+		values[n] = v
+	}
+	// Additive metrics can be calculated in slices, all placeholders used by metric or reduce SQL need values
+	staging := ""
+	checked := tmpl
+	if c.Slice != "" {
+		if strings.TrimSpace(hdr.Reduce) == "" {
+			return res, fmt.Errorf("metric '%s' doesn't declare reduce SQL in its front-matter, so it cannot be calculated in %sSLICE slices", c.Metric, Prefix)
+		}
+		staging = sliceTable()
+		values["slices"] = staging
+		checked += "\n" + hdr.Reduce
+	}
+	err = checkPlaceholders(checked, values, explicit, &c)
+	if err != nil {
+		return res, err
+	}
+	c.ColumnTypes, err = columnTypes(tmpl, hdr.ColumnTypes, &c)
+	if err != nil {
+		return res, err
+	}
+	if c.Drop {
+		dropTable := fmt.Sprintf(`drop table if exists "%s"`, table)
+		if debug {
+			Logf("drop table:\n%s\n", dropTable)
+		}
+		_, err = db.ExecContext(ctx, dropTable)
+		if err != nil {
+			QueryOut(dropTable, []interface{}{}...)
+			return res, err
+		}
+	}
+	// Per Project Tables
+	if c.PPT {
+		table += "_" + toDBIdentifier(c.ProjectSlug)
+	}
+	res.Table = table
+	needsCalc, dtf, dtt, err := needsCalculation(ctx, db, table, &c, now)
+	if err != nil {
+		return res, err
+	}
+	deleted := supportDelete(ctx, db, table, &c, dtf, dtt)
+	if deleted {
+		needsCalc, dtf, dtt, err = needsCalculation(ctx, db, table, &c, now)
+		if err != nil {
+			return res, err
+		}
+	}
+	res.DateFrom, res.DateTo = dtf, dtt
+	res.Fiscal = isFiscalRange(&c, now)
+	if !needsCalc && c.ForceCalc {
+		needsCalc = true
+		Logf("table '%s' doesn't need calculation but it was requested to calculate anyway\n", table)
+	}
+	if !needsCalc {
+		if debug {
+			Logf("table '%s' doesn't need calculation now\n", table)
+		}
+		return res, nil
+	}
+	// Only one run can calculate given window at a time, the other one skips it or waits for it
+	lock, err := lockWindow(ctx, db, table, &c, dtf, dtt)
+	if err != nil {
+		return res, err
+	}
+	if lock == nil {
+		res.Locked = true
+		Logf("table '%s' window %s - %s is being calculated by another run, skipping\n", table, ToYMDQuoted(dtf), ToYMDQuoted(dtt))
+		return res, nil
+	}
+	defer lock.Release()
+	// Window could have been calculated by the run that held the lock
+	if !c.ForceCalc {
+		isCalc, err := isCalculated(ctx, db, table, &c, dtf, dtt, res.Fiscal)
+		if err != nil {
+			return res, err
+		}
+		if isCalc {
+			if debug {
+				Logf("table '%s' was calculated by another run\n", table)
+			}
+			return res, nil
+		}
+	}
+	dtfs := ToYMDQuoted(dtf)
+	dtts := ToYMDQuoted(dtt)
+	var sql string
+	if staging != "" {
+		// Staging table is locked while it exists, so sync can drop it if this run crashes, see SweepSlices
+		err = lock.Hold(ctx, staging)
+		if err != nil {
+			return res, err
+		}
+		defer dropSlices(context.Background(), db, staging, debug)
+		sql, err = calculateSlices(ctx, db, tmpl, hdr.Reduce, staging, values, dtf, dtt, &c, &res)
+		if err != nil {
+			return res, err
+		}
+	} else {
+		values["date_from"] = dtfs
+		values["date_to"] = dtts
+		sql, err = renderTemplate(tmpl, values)
+		if err != nil {
+			return res, err
+		}
+		left := unresolvedPlaceholders(sql)
+		if len(left) > 0 {
+			return res, fmt.Errorf("metric '%s' generated SQL still contains placeholders: %s", c.Metric, strings.Join(left, ", "))
+		}
+	}
+	if debug {
+		Logf("generated SQL:\n%s\n", sql)
+	}
+	err = calculate(ctx, db, sql, table, dtf, dtt, &c, &res)
+	if err != nil {
+		return res, err
+	}
+	supportCleanup(ctx, db, table, &c, dtf, dtt, res.Fiscal)
+	return res, nil
+}
+
+// checkPlaceholders - fails if metric SQL uses placeholders that have no value and warns about unused V3_PARAM_xyz values
+// {{date_from}} and {{date_to}} are always provided, so they are not required in values
+// Only params explicitly passed by the caller are reported as unused, front-matter defaults are not
+func checkPlaceholders(tmpl string, values, explicit map[string]string, c *Calculation) error {
+	provided := map[string]string{"date_from": "", "date_to": ""}
+	for k, v := range values {
+		provided[k] = v
+	}
+	missing, unused := templateUsage(tmpl, provided)
+	for _, name := range unused {
+		_, param := explicit[name]
+		if param {
+			Logf("warning: %sPARAM_%s is not used by metric '%s'\n", Prefix, name, c.Metric)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("metric '%s' uses placeholders without values: %s, you can define them via %sPARAM_name", c.Metric, strings.Join(missing, ", "), Prefix)
+	}
+	return nil
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
@@ -24,7 +27,31 @@ import (
 )
 
 const (
-	gPrefix = "V3_"
+	gPrefix = lib.Prefix
+	// time given to calcmetric subprocess to report its own timeout before it is killed
+	gKillSlack = 10 * time.Second
+	// time given to running tasks to finish after SIGTERM/SIGINT, can be changed via V3_GRACE_PERIOD
+	gGracePeriod = 60 * time.Second
+	// default delay before the first retry of a failed task and maximum delay, see retryPolicy
+	gRetryDelay    = 5 * time.Second
+	gRetryMaxDelay = 5 * time.Minute
+	// how often sync checks if the lock held by another sync was released when V3_LOCK_WAIT is set
+	gLockPollInterval = 5 * time.Second
+	// how often sync checks that connection holding its locks is alive
+	gLockKeepAliveInterval = 30 * time.Second
+)
+
+// Task orders (V3_SCHEDULE)
+const (
+	gScheduleLPT    = "lpt"    // longest tasks first, using durations from previous runs, default
+	gScheduleRandom = "random" // random order
+)
+
+// Lock scopes (V3_LOCK)
+const (
+	gLockConfig = "config" // single lock for calculations.yaml, default
+	gLockEntry  = "entry"  // lock per calculations.yaml entry
+	gLockNone   = "none"   // no lock
 )
 
 var (
@@ -35,8 +62,28 @@ var (
 	gMtx         *snc.Mutex
 	gProcessing  map[int]map[string]string
 	gTaskIndices map[string]map[int]struct{}
+	// 0 - all tasks succeeded or were skipped
+	// 1 - sync error or some tasks failed
+	// lib.TimeoutExitCode - no tasks failed, but some timed out or were not started before V3_DEADLINE
+	// 128 + signal number - sync was stopped by SIGTERM/SIGINT
+	gExitCode = 0
+	// metric_sync_run history record of this sync run, nil when history is not saved (V3_NO_HISTORY)
+	gSyncRun *lib.SyncRun
 )
 
+// taskResult - outcome of a single task, sent back to runTasks when task finishes
+type taskResult struct {
+	idx        int           // task index
+	rows       int           // number of rows written, always 0 in subprocess mode as calcmetric doesn't report it
+	skipped    bool          // calculation was not needed or produced no data
+	took       time.Duration // task duration including retries
+	timeout    bool          // task failed because it exceeded its timeout, statement timeout or sync deadline
+	aborted    bool          // task was cancelled because sync was stopped by SIGTERM/SIGINT
+	blocked    bool          // task was not started because a task it depends on didn't succeed
+	notStarted bool          // task was not started because sync was stopped or its deadline was exceeded, only used by history
+	err        error
+}
+
 // Metrics contain all metrics to calculate
 type Metrics struct {
 	Metrics map[string]Metric `yaml:"metrics"`
@@ -52,12 +99,43 @@ type Metric struct {
 	// Can also use "top:N", for example "top:5" - it will return top 5 slugs by number of contributions for all time then.
 	ProjectSlugs string `yaml:"project_slugs"` // Comma separated list of V3_PROJECT_SLUG values, can also be SQL like `"sql:select distinct project_slug from mv_subprojects"`
 	// Can be overwritten with V3_TIME_RANGES env variable
-	TimeRanges  string            `yaml:"time_ranges"`  // Comma separated list of time ranges (V3_TIME_RANGE) to calculate or "all" which means all supported time ranges
-	ExtraParams map[string]string `yaml:"extra_params"` // map k:v with `V3_PARAM_` prefix skipped in keys, for example: tenant_id="'875c38bd-2b1b-4e91-ad07-0cfbabb4c49f'", is_bot='!= true'
-	ExtraEnv    map[string]string `yaml:"extra_env"`    // map k:v with `V3_` prefix skipped in keys, for example: DEBUG=1 DATE_FROM=2023-10-01 DATE_TO=2023-11-01
+	TimeRanges      string            `yaml:"time_ranges"`       // Comma separated list of time ranges (V3_TIME_RANGE) to calculate or "all" which means all supported time ranges
+	ExtraParams     map[string]string `yaml:"extra_params"`      // map k:v with `V3_PARAM_` prefix skipped in keys, for example: tenant_id="'875c38bd-2b1b-4e91-ad07-0cfbabb4c49f'", is_bot='!= true'
+	ExtraEnv        map[string]string `yaml:"extra_env"`         // map k:v with `V3_` prefix skipped in keys, for example: DEBUG=1 DATE_FROM=2023-10-01 DATE_TO=2023-11-01
+	TimeZone        string            `yaml:"timezone"`          // IANA time zone name used for time ranges, maps to V3_TZ, for example: Europe/Warsaw
+	WeekStart       string            `yaml:"week_start"`        // first day of week for week based time ranges, maps to V3_WEEK_START, for example: sunday
+	FiscalYearStart string            `yaml:"fiscal_year_start"` // first month of fiscal year, maps to V3_FISCAL_YEAR_START, for example: 7
+	Bucket          string            `yaml:"bucket"`            // time-series bucket granularity: day, week or month, maps to V3_BUCKET
+	Slice           string            `yaml:"slice"`             // calculate additive metrics in day, week, month, quarter or year slices, maps to V3_SLICE
+	ColumnTypes     map[string]string `yaml:"column_types"`      // map column:type of result table column types overrides, maps to V3_COLUMN_TYPES, for example: memberid=uuid
 	// Specify how often given metric should be run, you can spacify any golang duration for this, for example "48h"
 	// it will check if last successful sync was > "48h" ago and only run then.
 	MaxFrequency string `yaml:"max_frequency"`
+	// Timeouts are golang durations, for example "30m", they can be set for all entries via V3_TIMEOUT and V3_STATEMENT_TIMEOUT
+	Timeout          string `yaml:"timeout"`           // Deadline for each task of this entry, maps to V3_TIMEOUT
+	StatementTimeout string `yaml:"statement_timeout"` // Postgres statement_timeout for each task of this entry, maps to V3_STATEMENT_TIMEOUT
+	// Can be overwritten with V3_BACKFILL_* env variables
+	Backfill *Backfill `yaml:"backfill"` // If set, custom time range windows are calculated instead of time_ranges
+	// Entries this entry reads from, each task of this entry starts after tasks of those entries for the same
+	// project slug and time range succeeded
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// Backfill describes a span expanded into custom ("c") time range windows of step length
+// More details in README.md
+type Backfill struct {
+	From   string `yaml:"from"`   // First window start, YYYY-MM-DD, V3_BACKFILL_FROM
+	To     string `yaml:"to"`     // Last window end (windows ending after it are skipped), today in entry's time zone if not specified, V3_BACKFILL_TO
+	Step   string `yaml:"step"`   // daily, weekly, monthly or quarterly, V3_BACKFILL_STEP
+	Mode   string `yaml:"mode"`   // tumbling (default) - windows follow each other, rolling - next window starts one step later, V3_BACKFILL_MODE
+	Window int    `yaml:"window"` // Window length in steps, 1 if not specified, V3_BACKFILL_WINDOW
+}
+
+// timeWindow - time range to calculate, dateFrom and dateTo are only set for custom ("c") time range
+type timeWindow struct {
+	timeRange string
+	dateFrom  string
+	dateTo    string
 }
 
 func getQuerySlugs(db *sql.DB, debug bool, query string) ([]string, error) {
@@ -93,11 +171,137 @@ func getQuerySlugs(db *sql.DB, debug bool, query string) ([]string, error) {
 	return slugs, nil
 }
 
+// envBackfill - returns backfill with V3_BACKFILL_* env variables overriding bf fields, nil if there is no backfill
+func envBackfill(bf *Backfill, env map[string]string) (*Backfill, error) {
+	_, ok := env["BACKFILL_FROM"]
+	if !ok {
+		return bf, nil
+	}
+	nbf := Backfill{}
+	if bf != nil {
+		nbf = *bf
+	}
+	strs := map[string]*string{
+		"BACKFILL_FROM": &nbf.From,
+		"BACKFILL_TO":   &nbf.To,
+		"BACKFILL_STEP": &nbf.Step,
+		"BACKFILL_MODE": &nbf.Mode,
+	}
+	for k, p := range strs {
+		v, ok := env[k]
+		if ok && v != "" {
+			*p = v
+		}
+	}
+	w, ok := env["BACKFILL_WINDOW"]
+	if ok && w != "" {
+		window, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, err
+		}
+		nbf.Window = window
+	}
+	return &nbf, nil
+}
+
+// entryLocation - returns time zone entry's tasks compute their time ranges in: entry's V3_TZ, sync's V3_TZ or local
+func entryLocation(env, task map[string]string) (*time.Location, error) {
+	tz, ok := task[gPrefix+"TZ"]
+	if !ok {
+		tz = env["TZ"]
+	}
+	if tz == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// windows - expands backfill span into custom time range windows, ending not later than now's date (in now's location)
+// k-th step boundary is always computed from the span start, monthly steps starting on 31st use last days of shorter months
+func (bf *Backfill) windows(now time.Time) ([]timeWindow, error) {
+	if bf.From == "" {
+		return nil, fmt.Errorf("backfill requires from date")
+	}
+	from, err := lib.TimeParseAny(bf.From)
+	if err != nil {
+		return nil, err
+	}
+	from = lib.DayStart(from)
+	to := lib.DateOf(lib.DayStart(now))
+	if bf.To != "" {
+		to, err = lib.TimeParseAny(bf.To)
+		if err != nil {
+			return nil, err
+		}
+		to = lib.DayStart(to)
+	}
+	var boundary func(k int) time.Time
+	switch bf.Step {
+	case "daily":
+		boundary = func(k int) time.Time { return from.AddDate(0, 0, k) }
+	case "weekly":
+		boundary = func(k int) time.Time { return from.AddDate(0, 0, 7*k) }
+	case "monthly":
+		boundary = func(k int) time.Time { return addMonths(from, k) }
+	case "quarterly":
+		boundary = func(k int) time.Time { return addMonths(from, 3*k) }
+	default:
+		return nil, fmt.Errorf("unknown backfill step: '%s', allowed: daily, weekly, monthly, quarterly", bf.Step)
+	}
+	window := bf.Window
+	if window == 0 {
+		window = 1
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("backfill window must be positive, got %d", window)
+	}
+	advance := window
+	switch bf.Mode {
+	case "", "tumbling":
+	case "rolling":
+		advance = 1
+	default:
+		return nil, fmt.Errorf("unknown backfill mode: '%s', allowed: tumbling, rolling", bf.Mode)
+	}
+	windows := []timeWindow{}
+	for k := 0; ; k += advance {
+		dtf, dtt := boundary(k), boundary(k+window)
+		if dtt.After(to) {
+			break
+		}
+		windows = append(windows, timeWindow{timeRange: "c", dateFrom: lib.ToYMD(dtf), dateTo: lib.ToYMD(dtt)})
+	}
+	return windows, nil
+}
+
+// addMonths - adds n months to dt, day is clamped to the last day of the resulting month
+func addMonths(dt time.Time, n int) time.Time {
+	first := time.Date(dt.Year(), dt.Month()+time.Month(n), 1, 0, 0, 0, 0, dt.Location())
+	day := dt.Day()
+	last := first.AddDate(0, 1, -1).Day()
+	if day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
 func logCommand(cmdAndArgs []string, env map[string]string) {
 	lib.Logf("command, arguments, environment:\n%+v\n%+v\n", cmdAndArgs, env)
 }
 
-func execCommand(debug bool, cmdAndArgs []string, env map[string]string) (string, bool, error) {
+// taskTimeout returns task's V3_TIMEOUT (or sync's V3_TIMEOUT), 0 means no timeout
+func taskTimeout(env, task map[string]string) (time.Duration, error) {
+	timeout, ok := task[gPrefix+"TIMEOUT"]
+	if !ok {
+		timeout = env["TIMEOUT"]
+	}
+	if timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(timeout)
+}
+
+func execCommand(ctx context.Context, debug bool, cmdAndArgs []string, env map[string]string) (string, bool, error) {
 	// Execution time
 	dtStart := time.Now()
 
@@ -120,7 +324,10 @@ func execCommand(debug bool, cmdAndArgs []string, env map[string]string) (string
 		lib.Logf("%s\n", strings.Join(args, " "))
 	}
 	// prepare command
-	cmd := exec.Command(command, arguments...)
+	cmd := exec.CommandContext(ctx, command, arguments...)
+	// on cancel ask the process to terminate first and kill it if it is still running after gKillSlack
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = gKillSlack
 	// Set its env
 	if len(env) > 0 {
 		newEnv := os.Environ()
@@ -149,10 +356,18 @@ func execCommand(debug bool, cmdAndArgs []string, env map[string]string) (string
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			rCode := exiterr.ExitCode()
-			if rCode == 66 {
+			if rCode == lib.SkippedExitCode {
 				err = nil
 				skipped = true
 			}
+			if rCode == lib.TimeoutExitCode {
+				err = fmt.Errorf("%w: %s exited with code %d", lib.ErrTimeout, command, rCode)
+			}
+		}
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w: %s killed: %v: %v", lib.ErrTimeout, command, ctx.Err(), err)
+		} else if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%s killed: %w: %v", command, ctx.Err(), err)
 		}
 	}
 	if err != nil {
@@ -172,6 +387,52 @@ func execCommand(debug bool, cmdAndArgs []string, env map[string]string) (string
 	return "stdout:\n" + stdOut.String() + "\nstderr: " + stdErr.String(), skipped, nil
 }
 
+// taskCalculation returns calculation for a task
+// Task's V3_ variables override those set for sync itself, just like in the subprocess mode
+func taskCalculation(env, task map[string]string) (lib.Calculation, error) {
+	calcEnv := make(map[string]string)
+	for k, v := range env {
+		calcEnv[k] = v
+	}
+	prefixLen := len(gPrefix)
+	for k, v := range task {
+		if strings.HasPrefix(k, gPrefix) {
+			calcEnv[k[prefixLen:]] = v
+		}
+	}
+	return lib.CalculationFromEnv(calcEnv)
+}
+
+// runCalculation runs a single task in-process using the shared connection pool
+// ctx carries sync's global deadline, task's own timeout is applied by lib.Run
+func runCalculation(ctx context.Context, db *sql.DB, env, task map[string]string) (lib.Result, error) {
+	calc, err := taskCalculation(env, task)
+	if err != nil {
+		return lib.Result{}, err
+	}
+	return lib.Run(ctx, db, calc)
+}
+
+// backfillCalculated returns true if task's custom time range window is already calculated, so it can be skipped
+func backfillCalculated(db *sql.DB, env, task map[string]string) (bool, error) {
+	calc, err := taskCalculation(env, task)
+	if err != nil {
+		return false, err
+	}
+	if calc.ForceCalc {
+		return false, nil
+	}
+	dtf, err := lib.TimeParseAny(calc.DateFrom)
+	if err != nil {
+		return false, err
+	}
+	dtt, err := lib.TimeParseAny(calc.DateTo)
+	if err != nil {
+		return false, err
+	}
+	return lib.IsCalculated(context.Background(), db, calc, dtf, dtt)
+}
+
 func getThreadsNum(debug bool, env map[string]string) int {
 	threads, ok := env["THREADS"]
 	if ok && threads != "" {
@@ -194,6 +455,25 @@ func getThreadsNum(debug bool, env map[string]string) int {
 	return thrN
 }
 
+// setSliceThreads - sets V3_SLICE_THREADS for tasks that don't specify it, so sliced tasks running in parallel
+// share CPUs instead of each of them using all of them
+func setSliceThreads(tasks []map[string]string, thrN int, env map[string]string) {
+	_, ok := env["SLICE_THREADS"]
+	if ok {
+		return
+	}
+	sliceThrN := runtime.NumCPU() / thrN
+	if sliceThrN < 1 {
+		sliceThrN = 1
+	}
+	for _, task := range tasks {
+		_, ok := task[gPrefix+"SLICE_THREADS"]
+		if !ok {
+			task[gPrefix+"SLICE_THREADS"] = strconv.Itoa(sliceThrN)
+		}
+	}
+}
+
 func createMetricLastSyncTable(db *sql.DB) error {
 	createTable := `create table metric_last_sync(
   metric_name text not null,
@@ -209,6 +489,186 @@ func createMetricLastSyncTable(db *sql.DB) error {
 	return nil
 }
 
+func createMetricTaskDurationTable(db *sql.DB) error {
+	createTable := `create table metric_task_duration(
+  metric_name text not null,
+  project_slug text not null,
+  time_range varchar(64) not null,
+  took double precision not null,
+  updated_at timestamp not null,
+  primary key(metric_name, project_slug, time_range)
+);
+  `
+	_, err := db.Exec(createTable)
+	if err != nil {
+		lib.QueryOut(createTable, []interface{}{}...)
+		return err
+	}
+	return nil
+}
+
+// taskDurationKey returns key identifying task in metric_task_duration table, backfill windows are keyed by their dates
+func taskDurationKey(task map[string]string) string {
+	return task["TASK_NAME"] + "|" + task[gPrefix+"PROJECT_SLUG"] + "|" + windowSyncTimeRange(task)
+}
+
+// taskDurations returns durations (in seconds) of previous calculations of all tasks
+func taskDurations(db *sql.DB, debug bool) (map[string]float64, error) {
+	durations := make(map[string]float64)
+	sqlQuery := `select metric_name, project_slug, time_range, took from metric_task_duration`
+	if debug {
+		lib.Logf("executing sql: %s\n", sqlQuery)
+	}
+	rows, err := db.Query(sqlQuery)
+	if err != nil {
+		e, ok := err.(*pq.Error)
+		if ok && e.Code.Name() == "undefined_table" {
+			lib.Logf("table metric_task_duration does not exist yet, creating it and assuming no task durations are known yet.\n")
+			return durations, createMetricTaskDurationTable(db)
+		}
+		lib.QueryOut(sqlQuery, []interface{}{}...)
+		return durations, err
+	}
+	defer func() { _ = rows.Close() }()
+	var (
+		name, slug, tr string
+		took           float64
+	)
+	for rows.Next() {
+		err := rows.Scan(&name, &slug, &tr, &took)
+		if err != nil {
+			return durations, err
+		}
+		durations[name+"|"+slug+"|"+tr] = took
+	}
+	return durations, rows.Err()
+}
+
+// durationSample returns duration of task's successful calculation to average with the previous ones, false when
+// task was skipped: its window was already calculated, so it took no time and would halve a long task's duration
+// each time it is skipped, making it start last when its window rolls over
+func durationSample(result taskResult, took time.Duration) (time.Duration, bool) {
+	if result.skipped {
+		return 0, false
+	}
+	return took, true
+}
+
+// recordDuration saves duration of task's successful calculation, it is averaged with the previous ones
+func recordDuration(db *sql.DB, task map[string]string, took time.Duration) {
+	sqlQuery := `insert into metric_task_duration(metric_name, project_slug, time_range, took, updated_at) values ($1, $2, $3, $4, now())
+    on conflict(metric_name, project_slug, time_range) do update set took = (metric_task_duration.took + excluded.took) / 2, updated_at = excluded.updated_at`
+	args := []interface{}{task["TASK_NAME"], task[gPrefix+"PROJECT_SLUG"], windowSyncTimeRange(task), took.Seconds()}
+	_, err := db.Exec(sqlQuery, args...)
+	if err != nil {
+		lib.Logf("error saving task duration for '%s': %+v\n", task["TASK_NAME"], err)
+		lib.QueryOut(sqlQuery, args...)
+	}
+}
+
+// slugSizes returns number of contributions of each project slug in the last quarter
+func slugSizes(db *sql.DB, debug bool) (map[string]float64, error) {
+	sizes := make(map[string]float64)
+	sqlQuery := `select p.project_slug, count(a.id) from activities a, mv_subprojects p
+    where a.segmentId = p.id and a.timestamp >= now() - '3 months'::interval and p.project_slug is not null
+    and trim(p.project_slug) != '' group by p.project_slug`
+	if debug {
+		lib.Logf("executing sql: %s\n", sqlQuery)
+	}
+	rows, err := db.Query(sqlQuery)
+	if err != nil {
+		lib.QueryOut(sqlQuery, []interface{}{}...)
+		return sizes, err
+	}
+	defer func() { _ = rows.Close() }()
+	var (
+		slug string
+		size float64
+	)
+	for rows.Next() {
+		err := rows.Scan(&slug, &size)
+		if err != nil {
+			return sizes, err
+		}
+		sizes[slug] = size
+	}
+	return sizes, rows.Err()
+}
+
+// sortLongestFirst sorts tasks by their expected duration, longest first: it is the duration of previous calculations
+// and for tasks that were never calculated it is estimated from project size (contributions) and time range length
+// (days), scaled by seconds per contribution-day observed for the known tasks
+// it is only a heuristic, so when durations or project sizes cannot be read it logs the error and estimates without them
+func sortLongestFirst(db *sql.DB, tasks []map[string]string, debug bool, env map[string]string) {
+	durations, err := taskDurations(db, debug)
+	if err != nil {
+		lib.Logf("error reading task durations, estimating all of them: %+v\n", err)
+		durations = make(map[string]float64)
+	}
+	now := time.Now()
+	n := len(tasks)
+	cost := make([]float64, n)
+	known := make([]bool, n)
+	nKnown := 0
+	for i, task := range tasks {
+		cost[i], known[i] = durations[taskDurationKey(task)]
+		if known[i] {
+			nKnown++
+		}
+	}
+	if nKnown < n {
+		sizes, err := slugSizes(db, debug)
+		if err != nil {
+			lib.Logf("error reading project sizes, estimating task durations from time ranges only: %+v\n", err)
+			sizes = make(map[string]float64)
+		}
+		units := make([]float64, n)
+		knownSecs, knownUnits := 0.0, 0.0
+		for i, task := range tasks {
+			days := 1
+			calc, err := taskCalculation(env, task)
+			if err == nil {
+				days, err = lib.TimeRangeDays(calc, now)
+			}
+			if err != nil || days < 1 {
+				days = 1
+			}
+			size := sizes[task[gPrefix+"PROJECT_SLUG"]]
+			if size < 1 {
+				size = 1
+			}
+			units[i] = size * float64(days)
+			if known[i] {
+				knownSecs += cost[i]
+				knownUnits += units[i]
+			}
+		}
+		ratio := 1.0
+		if knownSecs > 0 && knownUnits > 0 {
+			ratio = knownSecs / knownUnits
+		}
+		for i := range tasks {
+			if !known[i] {
+				cost[i] = ratio * units[i]
+			}
+		}
+	}
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return cost[idx[a]] > cost[idx[b]] })
+	sorted := make([]map[string]string, n)
+	for i, j := range idx {
+		sorted[i] = tasks[j]
+	}
+	copy(tasks, sorted)
+	lib.Logf("scheduling %d tasks longest first, %d with known durations, %d estimated\n", n, nKnown, n-nKnown)
+	if debug && n > 0 {
+		lib.Logf("longest task: %s %s %s (%.1fs), shortest task: %s %s %s (%.1fs)\n", tasks[0]["TASK_NAME"], tasks[0][gPrefix+"PROJECT_SLUG"], windowSyncTimeRange(tasks[0]), cost[idx[0]], tasks[n-1]["TASK_NAME"], tasks[n-1][gPrefix+"PROJECT_SLUG"], windowSyncTimeRange(tasks[n-1]), cost[idx[n-1]])
+	}
+}
+
 func markAsDone(db *sql.DB, task string) {
 	// insert into metric_last_sync(metric_name, last_synced_at) values ('metric-name', now()) on conflict(metric_name) do update set last_synced_at = excluded.last_synced_at;
 	// metric_name is: key:table:metric (key - calculations.yaml metric key/name, table: given key's entry table, metric: given key's entry one of metrics values.
@@ -221,6 +681,82 @@ func markAsDone(db *sql.DB, task string) {
 	}
 }
 
+func createMetricLastSyncWindowTable(db *sql.DB) error {
+	createTable := `create table metric_last_sync_window(
+  metric_name text not null,
+  project_slug text not null,
+  time_range varchar(64) not null,
+  last_synced_at timestamp not null,
+  primary key(metric_name, project_slug, time_range)
+);
+  `
+	_, err := db.Exec(createTable)
+	if err != nil {
+		lib.QueryOut(createTable, []interface{}{}...)
+		return err
+	}
+	return nil
+}
+
+// windowSyncTimeRange returns time range saved in metric_last_sync_window, custom time range includes its dates
+func windowSyncTimeRange(task map[string]string) string {
+	tr := task[gPrefix+"TIME_RANGE"]
+	if task[gPrefix+"DATE_FROM"] != "" {
+		tr += ":" + task[gPrefix+"DATE_FROM"] + ":" + task[gPrefix+"DATE_TO"]
+	}
+	return tr
+}
+
+// windowSyncKey returns key of windowsLastSync map for a task
+func windowSyncKey(task map[string]string) string {
+	return task[gPrefix+"PROJECT_SLUG"] + "|" + windowSyncTimeRange(task)
+}
+
+// windowsLastSync returns last successful sync of each project slug and time range of a task group
+func windowsLastSync(db *sql.DB, task string, debug bool) (map[string]time.Time, error) {
+	synced := make(map[string]time.Time)
+	sqlQuery := `select project_slug, time_range, last_synced_at from metric_last_sync_window where metric_name = $1`
+	args := []interface{}{task}
+	if debug {
+		lib.Logf("executing sql: %s\nwith args: %+v\n", sqlQuery, args)
+	}
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		e, ok := err.(*pq.Error)
+		if ok && e.Code.Name() == "undefined_table" {
+			lib.Logf("table metric_last_sync_window does not exist yet, creating it and assuming nothing was synced yet.\n")
+			return synced, createMetricLastSyncWindowTable(db)
+		}
+		lib.QueryOut(sqlQuery, args...)
+		return synced, err
+	}
+	defer func() { _ = rows.Close() }()
+	var (
+		slug, tr string
+		lastSync time.Time
+	)
+	for rows.Next() {
+		err := rows.Scan(&slug, &tr, &lastSync)
+		if err != nil {
+			return synced, err
+		}
+		synced[slug+"|"+tr] = lastSync
+	}
+	return synced, rows.Err()
+}
+
+// markWindowAsDone saves last successful sync of task's project slug and time range
+func markWindowAsDone(db *sql.DB, task map[string]string) {
+	sqlQuery := `insert into metric_last_sync_window(metric_name, project_slug, time_range, last_synced_at) values ($1, $2, $3, now())
+    on conflict(metric_name, project_slug, time_range) do update set last_synced_at = excluded.last_synced_at`
+	args := []interface{}{task["TASK_NAME"], task[gPrefix+"PROJECT_SLUG"], windowSyncTimeRange(task)}
+	_, err := db.Exec(sqlQuery, args...)
+	if err != nil {
+		lib.Logf("error setting last_synced_at for '%s' %s %s: %+v\n", task["TASK_NAME"], args[1], args[2], err)
+		lib.QueryOut(sqlQuery, args...)
+	}
+}
+
 // returns last synced date and whatever we need to do sync now or not
 func checkFrequency(db *sql.DB, task string, freq time.Duration, debug bool) (time.Time, bool, error) {
 	// metric_last_sync(metric_name, last_synced_at)
@@ -273,27 +809,53 @@ func checkFrequency(db *sql.DB, task string, freq time.Duration, debug bool) (ti
 	return now, true, nil
 }
 
-func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) error {
-	path, ok := env["BIN_PATH"]
-	if !ok {
-		path = "./"
-	}
-	calcBin := path + "calcmetric"
-	if debug {
-		lib.Logf("will use '%s' binary to calculate metrics\n", calcBin)
+// entryLock is not nil when each entry is locked separately (V3_LOCK=entry)
+// lockLost is closed when connection holding sync's locks is lost, sync stops starting new tasks then
+func runTasks(db *sql.DB, metrics Metrics, entryLock *syncLock, lockLost <-chan struct{}, debug bool, env map[string]string) error {
+	calcBin := ""
+	_, subprocess := env["SUBPROCESS"]
+	if subprocess {
+		path, ok := env["BIN_PATH"]
+		if !ok {
+			path = "./"
+		}
+		calcBin = path + "calcmetric"
+		if debug {
+			lib.Logf("will use '%s' binary to calculate metrics\n", calcBin)
+		}
+	} else if debug {
+		lib.Logf("will calculate metrics in-process\n")
 	}
 	allTasks := []map[string]string{}
+	lockedEntries := make(map[string]struct{})
 	for taskName, taskDef := range metrics.Metrics {
+		// Entry lock, entries locked by another sync are skipped
+		if entryLock != nil {
+			locked, err := entryLock.acquire(taskName)
+			if err != nil {
+				return err
+			}
+			if !locked {
+				lib.Logf("skipping entry '%s', it is being calculated by another sync, entries depending on it are blocked\n", taskName)
+				lockedEntries[taskName] = struct{}{}
+				continue
+			}
+		}
+
 		// Task table
 		table := taskDef.Table
 
 		// Metrics to run
 		var metrics []string
 
-		// Check frequency from "metric_last_sync" table if defined
+		// Check frequency from "metric_last_sync_window" table if defined, only tasks that were not synced
+		// within max frequency (or that failed) are run
 		maxFreq := strings.TrimSpace(taskDef.MaxFrequency)
+		var freq time.Duration
+		lastSynced := make(map[string]map[string]time.Time)
 		if maxFreq != "" {
-			freq, err := time.ParseDuration(maxFreq)
+			var err error
+			freq, err = time.ParseDuration(maxFreq)
 			if err != nil {
 				return err
 			}
@@ -304,10 +866,16 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 				if err != nil {
 					return err
 				}
-				if !shouldRun {
+				synced, err := windowsLastSync(db, tName, debug)
+				if err != nil {
+					return err
+				}
+				// "metric_last_sync" is only used when there is no per project slug and time range data yet
+				if len(synced) == 0 && !shouldRun {
 					lib.Logf("skipping running '%s' due to frequency check: %s/%+v, last run: %+v\n", taskName, maxFreq, freq, lastRun)
 					continue
 				}
+				lastSynced[metricName] = synced
 				metrics = append(metrics, metricName)
 			}
 		} else {
@@ -365,7 +933,10 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 		} else if ranges == "all-current" {
 			ranges = "7d,30d,q,ty,y,2y,a"
 		}
-		rangesAry := strings.Split(ranges, ",")
+		windows := []timeWindow{}
+		for _, rng := range strings.Split(ranges, ",") {
+			windows = append(windows, timeWindow{timeRange: rng})
+		}
 
 		// Extra params
 		for k, v := range taskDef.ExtraParams {
@@ -377,32 +948,124 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 			task[gPrefix+k] = v
 		}
 
+		// Time zone
+		if taskDef.TimeZone != "" {
+			task[gPrefix+"TZ"] = taskDef.TimeZone
+		}
+
+		// Backfill, windows end today in entry's time zone
+		backfill, err := envBackfill(taskDef.Backfill, env)
+		if err != nil {
+			return err
+		}
+		if backfill != nil {
+			loc, err := entryLocation(env, task)
+			if err != nil {
+				return fmt.Errorf("entry '%s': %+v", taskName, err)
+			}
+			windows, err = backfill.windows(time.Now().In(loc))
+			if err != nil {
+				return fmt.Errorf("entry '%s': %+v", taskName, err)
+			}
+		}
+
+		// Week start
+		if taskDef.WeekStart != "" {
+			task[gPrefix+"WEEK_START"] = taskDef.WeekStart
+		}
+
+		// Fiscal year start
+		if taskDef.FiscalYearStart != "" {
+			task[gPrefix+"FISCAL_YEAR_START"] = taskDef.FiscalYearStart
+		}
+
+		// Time-series bucket
+		if taskDef.Bucket != "" {
+			task[gPrefix+"BUCKET"] = taskDef.Bucket
+		}
+
+		// Timeouts
+		if taskDef.Timeout != "" {
+			task[gPrefix+"TIMEOUT"] = taskDef.Timeout
+		}
+		if taskDef.StatementTimeout != "" {
+			task[gPrefix+"STATEMENT_TIMEOUT"] = taskDef.StatementTimeout
+		}
+
+		// Slices
+		if taskDef.Slice != "" {
+			task[gPrefix+"SLICE"] = taskDef.Slice
+		}
+
+		// Column types
+		if len(taskDef.ColumnTypes) > 0 {
+			types := []string{}
+			for k, v := range taskDef.ColumnTypes {
+				types = append(types, k+":"+v)
+			}
+			sort.Strings(types)
+			task[gPrefix+"COLUMN_TYPES"] = strings.Join(types, ",")
+		}
+
 		// Table
 		task[gPrefix+"TABLE"] = table
 
 		// Main loop creating all tasks to execute
 		nMetrics := len(metrics)
 		nSlugs := len(slugsAry)
-		nRanges := len(rangesAry)
+		nRanges := len(windows)
 		nItems := nMetrics * nSlugs * nRanges
-		lib.Logf("entry '%s' has %d metrics, %d project slugs, %d time-ranges ranges: %d tasks\n", taskName, nMetrics, nSlugs, nRanges, nItems)
+		if backfill != nil {
+			lib.Logf("entry '%s' has %d metrics, %d project slugs, %d backfill windows: %d tasks\n", taskName, nMetrics, nSlugs, nRanges, nItems)
+		} else {
+			lib.Logf("entry '%s' has %d metrics, %d project slugs, %d time-ranges ranges: %d tasks\n", taskName, nMetrics, nSlugs, nRanges, nItems)
+		}
+		nCalculated, nSynced := 0, 0
+		now := time.Now()
 		for _, metric := range metrics {
 			metricName := strings.TrimSpace(metric)
 			for _, slug := range slugsAry {
-				for _, rng := range rangesAry {
+				for _, window := range windows {
 					// Final task to execute
 					newTask := make(map[string]string)
 					for k, v := range task {
 						newTask[k] = v
 					}
 					newTask[gPrefix+"METRIC"] = metricName
-					newTask[gPrefix+"TIME_RANGE"] = rng
+					newTask[gPrefix+"TIME_RANGE"] = window.timeRange
+					if window.dateFrom != "" {
+						newTask[gPrefix+"DATE_FROM"] = window.dateFrom
+						newTask[gPrefix+"DATE_TO"] = window.dateTo
+					}
 					newTask[gPrefix+"PROJECT_SLUG"] = slug
 					newTask["TASK_NAME"] = taskName + ":" + table + ":" + metricName
+					if maxFreq != "" {
+						last, ok := lastSynced[metricName][windowSyncKey(newTask)]
+						if ok && now.Sub(last) <= freq {
+							nSynced++
+							continue
+						}
+					}
+					if backfill != nil {
+						calculated, err := backfillCalculated(db, env, newTask)
+						if err != nil {
+							return err
+						}
+						if calculated {
+							nCalculated++
+							continue
+						}
+					}
 					allTasks = append(allTasks, newTask)
 				}
 			}
 		}
+		if nCalculated > 0 {
+			lib.Logf("entry '%s': skipped %d already calculated backfill windows\n", taskName, nCalculated)
+		}
+		if nSynced > 0 {
+			lib.Logf("entry '%s': skipped %d tasks synced within %s max frequency\n", taskName, nSynced, maxFreq)
+		}
 	}
 	lib.Logf("%d tasks\n", len(allTasks))
 	if debug {
@@ -415,6 +1078,19 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(allTasks), func(i, j int) { allTasks[i], allTasks[j] = allTasks[j], allTasks[i] })
 
+	// then start the longest tasks first (LPT), so a long task started last doesn't dominate the wall-clock time
+	schedule, ok := env["SCHEDULE"]
+	if !ok || schedule == "" {
+		schedule = gScheduleLPT
+	}
+	switch schedule {
+	case gScheduleLPT:
+		sortLongestFirst(db, allTasks, debug, env)
+	case gScheduleRandom:
+	default:
+		return fmt.Errorf("unknown schedule: '%s', allowed: %s, %s", schedule, gScheduleLPT, gScheduleRandom)
+	}
+
 	// handle lists of indices per task name, to know when a given task is fully finished
 	gTaskIndices = make(map[string]map[int]struct{})
 	for i, task := range allTasks {
@@ -434,7 +1110,7 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 	gProcessing = make(map[int]map[string]string)
 
 	// Retry
-	retry := 0
+	retry := retryPolicy{delay: gRetryDelay, maxDelay: gRetryMaxDelay}
 	rs, ok := env["RETRY"]
 	if ok && rs != "" {
 		r, err := strconv.Atoi(rs)
@@ -442,9 +1118,24 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 			return err
 		}
 		if r > 0 {
-			retry = r
-			lib.Logf("set retry to: %d\n", retry)
+			retry.retries = r
+			lib.Logf("set retry to: %d\n", retry.retries)
+		}
+	}
+	delays := map[string]*time.Duration{
+		"RETRY_DELAY":     &retry.delay,
+		"RETRY_MAX_DELAY": &retry.maxDelay,
+	}
+	for k, p := range delays {
+		v, ok := env[k]
+		if !ok || v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
 		}
+		*p = d
 	}
 
 	// Heartbeat
@@ -475,12 +1166,74 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 		}()
 	}
 
+	_, dryRun := env["DRY_RUN"]
+	if dryRun {
+		lib.Logf("running in dry-run mode.\n")
+	}
+
+	// Global deadline, tasks are not started after it and running tasks are cancelled
+	ctx := context.Background()
+	deadline, ok := env["DEADLINE"]
+	if ok && deadline != "" {
+		d, err := time.ParseDuration(deadline)
+		if err != nil {
+			return err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		lib.Logf("sync deadline: %v\n", d)
+	}
+
+	// Graceful shutdown: after SIGTERM/SIGINT no new tasks are started and running tasks are cancelled after grace period
+	grace := gGracePeriod
+	gp, ok := env["GRACE_PERIOD"]
+	if ok && gp != "" {
+		d, err := time.ParseDuration(gp)
+		if err != nil {
+			return err
+		}
+		grace = d
+	}
+	ctx, cancelTasks := context.WithCancel(ctx)
+	defer cancelTasks()
+	stop := make(chan struct{})
+	var (
+		stopSig  os.Signal
+		stopOnce snc.Once
+		lostLock bool
+	)
+	stopTasks := func() { stopOnce.Do(func() { close(stop) }) }
+	// closed when runTasks returns, so its goroutines exit
+	finished := make(chan struct{})
+	defer close(finished)
+
 	// Signals
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
 	go func() {
 		for {
-			sig := <-sigs
+			var sig os.Signal
+			select {
+			case <-finished:
+				return
+			case sig = <-sigs:
+			}
+			if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+				gMtx.Lock()
+				if stopSig == nil {
+					stopSig = sig
+					stopTasks()
+					lib.Logf("signal(%d): stopping, not starting new tasks, %d running tasks will be cancelled in %v (send signal again to cancel them now)\n", sig, len(gProcessing), grace)
+					time.AfterFunc(grace, cancelTasks)
+				} else {
+					lib.Logf("signal(%d): cancelling %d running tasks now\n", sig, len(gProcessing))
+					cancelTasks()
+				}
+				gMtx.Unlock()
+				continue
+			}
 			gMtx.Lock()
 			lib.Logf("signal(%d): %d tasks processing\n", sig, len(gProcessing))
 			for idx, task := range gProcessing {
@@ -492,58 +1245,304 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 		}
 	}()
 
-	_, dryRun := env["DRY_RUN"]
-	if dryRun {
-		lib.Logf("running in dry-run mode.\n")
+	// Another sync can take the lock now, so no new tasks are started, running tasks hold their own window locks
+	go func() {
+		select {
+		case <-finished:
+			return
+		case <-lockLost:
+		}
+		gMtx.Lock()
+		lostLock = true
+		lib.Logf("sync lock lost: stopping, not starting new tasks, waiting for %d running tasks\n", len(gProcessing))
+		gMtx.Unlock()
+		stopTasks()
+	}()
+
+	stopping := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return ctx.Err() != nil
+		}
 	}
 
-	// process tasks
+	// process tasks, task is started only after all tasks it depends on succeeded
+	graph, blocked := newTaskGraph(allTasks, metrics, lockedEntries)
 	thrN := getThreadsNum(debug, env)
+	setSliceThreads(allTasks, thrN, env)
 	numTasks := len(allTasks)
+	results := blocked
+	started := 0
 	if thrN > 1 {
-		ch := make(chan error)
+		ch := make(chan taskResult)
 		nThreads := 0
-		for i := range allTasks {
-			if i > 0 && i%50 == 0 {
-				lib.Logf("on %d/%d task\n", i, numTasks)
-			}
-			go processTask(ch, db, i, retry, debug, dryRun, calcBin, allTasks)
-			nThreads++
-			if nThreads == thrN {
-				err := <-ch
-				nThreads--
-				if err != nil {
-					lib.Logf("error: %+v\n", err)
+		for {
+			for nThreads < thrN && !stopping() {
+				i, ok := graph.next()
+				if !ok {
+					break
+				}
+				if started > 0 && started%50 == 0 {
+					lib.Logf("on %d/%d task\n", started, numTasks)
 				}
+				go processTask(ctx, stop, ch, db, i, retry, debug, dryRun, calcBin, env, allTasks)
+				nThreads++
+				started++
 			}
-		}
-		if debug {
-			lib.Logf("Final %d threads join\n", nThreads)
-		}
-		for nThreads > 0 {
-			err := <-ch
+			if nThreads == 0 {
+				break
+			}
+			res := <-ch
 			nThreads--
 			if debug {
-				lib.Logf("%d threads left\n", nThreads)
+				lib.Logf("%d threads running\n", nThreads)
 			}
-			if err != nil {
-				lib.Logf("error: %+v\n", err)
+			if res.err != nil {
+				lib.Logf("error: %+v\n", res.err)
 			}
+			results = append(results, res)
+			results = append(results, graph.finish(res)...)
 		}
 	} else {
-		for i := range allTasks {
-			if i > 0 && i%50 == 0 {
-				lib.Logf("on %d/%d task\n", i, numTasks)
+		for !stopping() {
+			i, ok := graph.next()
+			if !ok {
+				break
+			}
+			if started > 0 && started%50 == 0 {
+				lib.Logf("on %d/%d task\n", started, numTasks)
 			}
-			err := processTask(nil, db, i, retry, debug, dryRun, calcBin, allTasks)
+			res := processTask(ctx, stop, nil, db, i, retry, debug, dryRun, calcBin, env, allTasks)
+			started++
+			if res.err != nil {
+				lib.Logf("error: %+v\n", res.err)
+			}
+			results = append(results, res)
+			results = append(results, graph.finish(res)...)
+		}
+	}
+	notStarted := numTasks - len(results)
+	gMtx.Lock()
+	sig, lost := stopSig, lostLock
+	gMtx.Unlock()
+	reason := ""
+	if sig != nil {
+		reason = fmt.Sprintf("sync stopped by signal(%d)", sig)
+	} else if lost {
+		reason = "sync stopped because its lock was lost"
+	} else if notStarted > 0 {
+		reason = "sync deadline exceeded"
+	}
+	if reason != "" {
+		lib.Logf("%s, %d tasks were not started\n", reason, notStarted)
+	}
+	if !dryRun {
+		saveNotRunTasks(db, allTasks, results, reason)
+	}
+	summarize(results, notStarted)
+	if sig != nil {
+		if s, ok := sig.(syscall.Signal); ok {
+			gExitCode = 128 + int(s)
+		}
+	}
+	if lost {
+		return fmt.Errorf("sync lock connection was lost, %d tasks were not started", notStarted)
+	}
+	return nil
+}
+
+// summarize logs tasks outcome and sets sync's exit code
+func summarize(results []taskResult, notStarted int) {
+	calculated, skipped, failed, timedOut, aborted, blocked, rows := 0, 0, 0, 0, 0, 0, 0
+	var took time.Duration
+	for _, res := range results {
+		took += res.took
+		rows += res.rows
+		if res.blocked {
+			blocked++
+		} else if res.aborted {
+			aborted++
+		} else if res.timeout {
+			timedOut++
+		} else if res.err != nil {
+			failed++
+		} else if res.skipped {
+			skipped++
+		} else {
+			calculated++
+		}
+	}
+	lib.Logf("%d tasks: %d calculated, %d skipped, %d failed, %d timed out, %d aborted, %d blocked by dependencies, %d not started, %d rows written, total tasks time: %v\n", len(results)+notStarted, calculated, skipped, failed, timedOut, aborted, blocked, notStarted, rows, took)
+	if gSyncRun != nil {
+		r := gSyncRun
+		r.Tasks, r.Calculated, r.Skipped, r.Failed, r.TimedOut = len(results)+notStarted, calculated, skipped, failed, timedOut
+		r.Aborted, r.Blocked, r.NotStarted, r.Rows = aborted, blocked, notStarted, rows
+	}
+	if failed > 0 {
+		gExitCode = 1
+	} else if timedOut > 0 || notStarted > 0 {
+		gExitCode = lib.TimeoutExitCode
+	}
+}
+
+// checkDependencies fails if depends_on refers to unknown entries or entries depend on each other in a cycle
+func checkDependencies(metrics Metrics) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("entries dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range metrics.Metrics[name].DependsOn {
+			_, ok := metrics.Metrics[dep]
+			if !ok {
+				return fmt.Errorf("entry '%s' depends on unknown entry '%s'", name, dep)
+			}
+			err := visit(dep, path)
 			if err != nil {
-				lib.Logf("error: %+v\n", err)
+				return err
 			}
 		}
+		state[name] = visited
+		return nil
+	}
+	names := []string{}
+	for name := range metrics.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := visit(name, nil)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// taskGraph - tasks dependencies, task of an entry depends on tasks of entries from its depends_on that have
+// the same project slug and time range (or backfill window), dependencies that have no such tasks are ignored
+type taskGraph struct {
+	ready      []int   // tasks that can be started now, sorted by index, so in tasks order (longest first)
+	waiting    []int   // number of not finished dependencies of each task
+	dependents [][]int // tasks depending on each task
+	blocked    []bool  // task will not be started because its dependency didn't succeed
+}
+
+// taskEntry returns calculations.yaml entry name of a task, TASK_NAME is entry:table:metric
+func taskEntry(task map[string]string) string {
+	name := task["TASK_NAME"]
+	for i := 0; i < 2; i++ {
+		j := strings.LastIndex(name, ":")
+		if j < 0 {
+			break
+		}
+		name = name[:j]
+	}
+	return name
+}
+
+// taskWindow returns key identifying task's project slug and time range
+func taskWindow(task map[string]string) string {
+	return strings.Join([]string{task[gPrefix+"PROJECT_SLUG"], task[gPrefix+"TIME_RANGE"], task[gPrefix+"DATE_FROM"], task[gPrefix+"DATE_TO"]}, ":")
+}
+
+// newTaskGraph returns tasks graph and results of tasks that are blocked from the start, because entries they depend on
+// are locked by another sync (V3_LOCK=entry), such entries have no tasks, so all tasks of their dependents are blocked
+func newTaskGraph(tasks []map[string]string, metrics Metrics, locked map[string]struct{}) (*taskGraph, []taskResult) {
+	n := len(tasks)
+	g := &taskGraph{waiting: make([]int, n), dependents: make([][]int, n), blocked: make([]bool, n)}
+	byWindow := make(map[string][]int)
+	for i, task := range tasks {
+		key := taskEntry(task) + "|" + taskWindow(task)
+		byWindow[key] = append(byWindow[key], i)
+	}
+	for i, task := range tasks {
+		for _, dep := range metrics.Metrics[taskEntry(task)].DependsOn {
+			for _, j := range byWindow[dep+"|"+taskWindow(task)] {
+				g.dependents[j] = append(g.dependents[j], i)
+				g.waiting[i]++
+			}
+		}
+	}
+	blocked := []taskResult{}
+	for i, task := range tasks {
+		if g.blocked[i] {
+			continue
+		}
+		for _, dep := range metrics.Metrics[taskEntry(task)].DependsOn {
+			_, ok := locked[dep]
+			if !ok {
+				continue
+			}
+			g.blocked[i] = true
+			lib.Logf("task #%d will not be started, entry '%s' it depends on is being calculated by another sync\n", i, dep)
+			blocked = append(blocked, taskResult{idx: i, blocked: true, err: fmt.Errorf("entry '%s' it depends on is being calculated by another sync", dep)})
+			blocked = append(blocked, g.block(i, i)...)
+			break
+		}
+	}
+	for i := range tasks {
+		if g.waiting[i] == 0 && !g.blocked[i] {
+			g.ready = append(g.ready, i)
+		}
+	}
+	return g, blocked
+}
+
+// next returns task that can be started now
+func (g *taskGraph) next() (int, bool) {
+	if len(g.ready) == 0 {
+		return 0, false
+	}
+	idx := g.ready[0]
+	g.ready = g.ready[1:]
+	return idx, true
+}
+
+// block marks all tasks depending (directly or not) on task idx as blocked by task cause and returns them as results
+func (g *taskGraph) block(idx, cause int) []taskResult {
+	blocked := []taskResult{}
+	for _, d := range g.dependents[idx] {
+		if g.blocked[d] {
+			continue
+		}
+		g.blocked[d] = true
+		lib.Logf("task #%d will not be started, task #%d it depends on didn't succeed\n", d, cause)
+		blocked = append(blocked, taskResult{idx: d, blocked: true, err: fmt.Errorf("task #%d it depends on didn't succeed", cause)})
+		blocked = append(blocked, g.block(d, cause)...)
+	}
+	return blocked
+}
+
+// finish marks task as finished, dependents of a task that didn't succeed are blocked and returned as results
+func (g *taskGraph) finish(res taskResult) []taskResult {
+	if res.err != nil {
+		return g.block(res.idx, res.idx)
+	}
+	for _, d := range g.dependents[res.idx] {
+		g.waiting[d]--
+		if g.waiting[d] == 0 && !g.blocked[d] {
+			i := sort.SearchInts(g.ready, d)
+			g.ready = append(g.ready, 0)
+			copy(g.ready[i+1:], g.ready[i:])
+			g.ready[i] = d
+		}
+	}
+	return []taskResult{}
+}
+
 func prettyPrintTask(idx int, task map[string]string) string {
 	var msg string
 	offset := len(gPrefix)
@@ -563,12 +1562,47 @@ func prettyPrintTask(idx int, task map[string]string) string {
 	return msg
 }
 
-func processTask(ch chan error, db *sql.DB, idx, retry int, debug, dryRun bool, binCmd string, tasks []map[string]string) error {
+// retryPolicy - how failed tasks are retried (V3_RETRY, V3_RETRY_DELAY, V3_RETRY_MAX_DELAY)
+type retryPolicy struct {
+	retries  int           // maximum number of retries
+	delay    time.Duration // delay before the first retry, doubled for each next one
+	maxDelay time.Duration // maximum delay
+}
+
+// backoff returns delay before given retry: exponential, capped at maxDelay, with random jitter (half to full delay)
+// so tasks that failed at the same time (for example because database restarted) are not retried at the same time
+func (r retryPolicy) backoff(retry int) time.Duration {
+	delay := r.delay
+	for i := 1; i < retry && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetriable returns true if task failed with an error that retrying can fix, calcmetric subprocess reports fatal
+// errors with lib.FatalExitCode
+func isRetriable(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode() != lib.FatalExitCode
+	}
+	return lib.IsRetriable(err)
+}
+
+// processTask runs task with retries, stop is closed when sync is stopping: pending retries are not started then
+func processTask(ctx context.Context, stop <-chan struct{}, ch chan taskResult, db *sql.DB, idx int, retry retryPolicy, debug, dryRun bool, binCmd string, env map[string]string, tasks []map[string]string) (result taskResult) {
 	var (
-		res     string
-		skipped bool
-		err     error
+		res  string
+		calc lib.Result
+		err  error
 	)
+	result.idx = idx
 	task := tasks[idx]
 	taskName := task["TASK_NAME"]
 	gMtx.Lock()
@@ -579,15 +1613,16 @@ func processTask(ch chan error, db *sql.DB, idx, retry int, debug, dryRun bool,
 		defer func() {
 			gMtx.Unlock()
 			if ch != nil {
-				ch <- err
+				ch <- result
 			}
 		}()
-		if err != nil {
+		// task is not running anymore whatever its outcome, so signals, heartbeat and stop messages don't count it
+		delete(gProcessing, idx)
+		if result.err != nil {
 			lib.Logf("task #%d failed, so not marking it as done\n", idx)
 			lib.Logf("%s\n", prettyPrintTask(idx, task))
 			return
 		}
-		delete(gProcessing, idx)
 		_, ok := gTaskIndices[taskName]
 		if ok {
 			delete(gTaskIndices[taskName], idx)
@@ -602,57 +1637,330 @@ func processTask(ch chan error, db *sql.DB, idx, retry int, debug, dryRun bool,
 		lib.Logf("%s\n", prettyPrintTask(idx, task))
 	}
 	dtStart := time.Now()
+	dtTrial := dtStart
+	attempts := 0
+	defer func() {
+		if !dryRun {
+			saveTaskRun(db, task, result, calc, err, dtStart, attempts)
+		}
+	}()
 	if dryRun {
-		res, skipped, err = "dry-run", false, nil
+		res, result.skipped, err = "dry-run", false, nil
 	} else {
-		for trial := 0; trial <= retry; trial++ {
+		for trial := 0; trial <= retry.retries; trial++ {
 			if trial > 0 {
-				lib.Logf("retry #%d for task #%d, details:\n", retry, idx)
+				if !isRetriable(err) {
+					lib.Logf("not retrying task #%d, it failed with a fatal error: %+v\n", idx, err)
+					break
+				}
+				delay := retry.backoff(trial)
+				lib.Logf("retry #%d/%d for task #%d in %v, it failed with: %+v, details:\n", trial, retry.retries, idx, delay, err)
 				lib.Logf("%s\n", prettyPrintTask(idx, task))
+				stopped := false
+				select {
+				case <-ctx.Done():
+				case <-stop:
+					stopped = true
+				case <-time.After(delay):
+				}
+				// error is replaced by the reason retry was not started, so the task is reported as aborted or timed out
+				if stopped {
+					lib.Logf("not retrying task #%d, sync is stopping\n", idx)
+					err = fmt.Errorf("%w: sync is stopping, retry #%d not started, last error: %v", context.Canceled, trial, err)
+					break
+				}
+				if ctx.Err() != nil {
+					lib.Logf("not retrying task #%d, sync is stopping or its deadline exceeded\n", idx)
+					err = fmt.Errorf("%w: retry #%d not started, last error: %v", ctx.Err(), trial, err)
+					break
+				}
+			}
+			dtTrial = time.Now()
+			attempts++
+			if binCmd != "" {
+				res, result.skipped, err = execSubprocess(ctx, debug, binCmd, env, task)
+			} else {
+				calc, err = runCalculation(ctx, db, env, task)
+				result.rows, result.skipped = calc.Rows, !calc.Calculated
+				res = fmt.Sprintf("table: %s, time range: %s - %s, rows: %d, loader: %s, query: %v, load: %v", calc.Table, lib.ToYMDQuoted(calc.DateFrom), lib.ToYMDQuoted(calc.DateTo), calc.Rows, calc.Loader, calc.QueryTime, calc.LoadTime)
 			}
-			res, skipped, err = execCommand(
-				debug,
-				[]string{binCmd},
-				task,
-			)
 			if err == nil {
 				break
 			}
 		}
 	}
 	dtEnd := time.Now()
-	took := dtEnd.Sub(dtStart)
+	result.took = dtEnd.Sub(dtStart)
 	if err != nil {
-		msg := fmt.Sprintf("task #%d (%+v) failed (took %v): %+v: %s\n", idx, task, dtEnd.Sub(dtStart), err, res)
+		// task cancelled after SIGTERM/SIGINT grace period (or its retry was not started), its task group is not marked as synced
+		if ctx.Err() == context.Canceled || errors.Is(err, context.Canceled) {
+			result.aborted = true
+			msg := fmt.Sprintf("task #%d (%+v) aborted (took %v): %+v: %s\n", idx, task, result.took, err, res)
+			if debug {
+				lib.Logf("%s\n", msg)
+			}
+			result.err = fmt.Errorf("%w: %s", context.Canceled, msg)
+			return
+		}
+		result.timeout = lib.IsTimeout(err)
+		if result.timeout {
+			msg := fmt.Sprintf("task #%d (%+v) timed out (took %v): %+v: %s\n", idx, task, result.took, err, res)
+			if debug {
+				lib.Logf("%s\n", msg)
+			}
+			result.err = fmt.Errorf("%w: %s", lib.ErrTimeout, msg)
+			return
+		}
+		msg := fmt.Sprintf("task #%d (%+v) failed (took %v): %+v: %s\n", idx, task, result.took, err, res)
 		if debug {
 			lib.Logf("%s\n", msg)
 		}
-		err = fmt.Errorf("%s", msg)
+		result.err = fmt.Errorf("%s", msg)
 	} else {
-		lib.Logf("task #%d finished in %v (skipped or no data: %v), details:\n", idx, took, skipped)
+		// window calculated by another run (V3_WINDOW_LOCK_WAIT) is marked as synced by that run
+		if !dryRun && !calc.Locked {
+			markWindowAsDone(db, task)
+			took, ok := durationSample(result, dtEnd.Sub(dtTrial))
+			if ok {
+				recordDuration(db, task, took)
+			}
+		}
+		lib.Logf("task #%d finished in %v (skipped or no data: %v, rows: %d), details:\n", idx, result.took, result.skipped, result.rows)
 		lib.Logf("%s\n", prettyPrintTask(idx, task))
 	}
 	if debug {
-		lib.Logf("task #%d (%+v) executed (skipped or no data: %v), took: %v\noutput/stderr:\n%s\n", idx, task, skipped, dtEnd.Sub(dtStart), res)
+		lib.Logf("task #%d (%+v) executed (skipped or no data: %v), took: %v\noutput:\n%s\n", idx, task, result.skipped, result.took, res)
 	}
-	return err
+	return
 }
 
-func sync() error {
-	gSlugsMap = make(map[string][]string)
-	env := make(map[string]string)
-	prefixLen := len(gPrefix)
-	for _, pair := range os.Environ() {
-		if strings.HasPrefix(pair, gPrefix) {
-			ary := strings.Split(pair, "=")
-			if len(ary) < 2 {
-				continue
-			}
-			key := ary[0]
-			val := strings.Join(ary[1:], "=")
-			env[key[prefixLen:]] = val
+// execSubprocess runs task using calcmetric binary, it is killed when task's timeout (plus some time for calcmetric
+// to report the timeout itself) or sync's deadline is exceeded
+func execSubprocess(ctx context.Context, debug bool, binCmd string, env, task map[string]string) (string, bool, error) {
+	timeout, err := taskTimeout(env, task)
+	if err != nil {
+		return "", false, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout+gKillSlack)
+		defer cancel()
+	}
+	// calcmetric doesn't save its history when run by sync, sync saves it
+	childEnv := make(map[string]string)
+	for k, v := range task {
+		childEnv[k] = v
+	}
+	childEnv[gPrefix+"SYNC_RUN_ID"] = "0"
+	if gSyncRun != nil {
+		childEnv[gPrefix+"SYNC_RUN_ID"] = strconv.FormatInt(gSyncRun.ID, 10)
+	}
+	return execCommand(ctx, debug, []string{binCmd}, childEnv)
+}
+
+// saveTaskRun saves task history record in metric_task_run table
+func saveTaskRun(db *sql.DB, task map[string]string, result taskResult, calc lib.Result, err error, dtStart time.Time, attempts int) {
+	if gSyncRun == nil {
+		return
+	}
+	run := lib.TaskRun{
+		SyncRunID:   gSyncRun.ID,
+		TaskName:    task["TASK_NAME"],
+		Metric:      task[gPrefix+"METRIC"],
+		Table:       task[gPrefix+"TABLE"],
+		ProjectSlug: task[gPrefix+"PROJECT_SLUG"],
+		TimeRange:   task[gPrefix+"TIME_RANGE"],
+		StartedAt:   dtStart,
+		FinishedAt:  dtStart.Add(result.took),
+		Rows:        result.rows,
+		Attempts:    attempts,
+	}
+	if calc.Table != "" {
+		// in-process calculation
+		run.Table, run.DateFrom, run.DateTo = calc.Table, calc.DateFrom, calc.DateTo
+	} else {
+		// calcmetric subprocess doesn't report rows and time range, only custom time range is known
+		run.Rows = -1
+		run.DateFrom, _ = lib.TimeParseAny(task[gPrefix+"DATE_FROM"])
+		run.DateTo, _ = lib.TimeParseAny(task[gPrefix+"DATE_TO"])
+	}
+	switch {
+	case result.blocked:
+		run.Status = lib.StatusBlocked
+	case result.notStarted:
+		run.Status = lib.StatusNotStarted
+	case result.aborted:
+		run.Status = lib.StatusAborted
+	case result.timeout:
+		run.Status = lib.StatusTimeout
+	case err != nil:
+		run.Status = lib.StatusFailed
+	case result.skipped:
+		run.Status = lib.StatusSkipped
+	default:
+		run.Status = lib.StatusCalculated
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	hErr := lib.SaveTaskRun(context.Background(), db, run)
+	if hErr != nil {
+		lib.Logf("error saving task #%d history: %+v\n", result.idx, hErr)
+	}
+}
+
+// saveNotRunTasks saves history records of tasks that were blocked by their dependencies or not started at all,
+// so every task of the sync run has its metric_task_run row
+func saveNotRunTasks(db *sql.DB, tasks []map[string]string, results []taskResult, reason string) {
+	if gSyncRun == nil {
+		return
+	}
+	now := time.Now()
+	done := make(map[int]struct{})
+	for _, res := range results {
+		done[res.idx] = struct{}{}
+		if res.blocked {
+			saveTaskRun(db, tasks[res.idx], res, lib.Result{}, res.err, now, 0)
 		}
 	}
+	for idx, task := range tasks {
+		_, ok := done[idx]
+		if ok {
+			continue
+		}
+		saveTaskRun(db, task, taskResult{idx: idx, notStarted: true}, lib.Result{}, errors.New(reason), now, 0)
+	}
+}
+
+// syncLock - Postgres session level advisory locks held by sync on a dedicated connection, they are released
+// when sync finishes or when its connection is closed (for example because sync crashed), so they are never stale
+type syncLock struct {
+	lock *lib.AdvisoryLock
+	key  string        // lock name prefix
+	wait time.Duration // how long to wait for a lock held by another sync
+	lost <-chan struct{}
+}
+
+// newSyncLock returns sync lock, its connection is pinged every gLockKeepAliveInterval and lost channel is closed
+// when it fails, because locks are released by Postgres with the connection
+func newSyncLock(db *sql.DB, key string, wait time.Duration, debug bool) (*syncLock, error) {
+	lock, err := lib.NewAdvisoryLock(context.Background(), db, debug)
+	if err != nil {
+		return nil, err
+	}
+	return &syncLock{lock: lock, key: key, wait: wait, lost: lock.KeepAlive(gLockKeepAliveInterval)}, nil
+}
+
+// acquire takes key or key:entry lock, it waits up to V3_LOCK_WAIT for it and returns false if it is still held by another sync
+func (l *syncLock) acquire(entry string) (bool, error) {
+	name := l.key
+	if entry != "" {
+		name += ":" + entry
+	}
+	return l.lock.Acquire(context.Background(), name, l.wait, gLockPollInterval)
+}
+
+// release releases all locks and the lock connection
+func (l *syncLock) release() {
+	l.lock.Release()
+}
+
+// syncLocks returns lock held for the whole sync run (V3_LOCK=config) and lock used for each entry (V3_LOCK=entry)
+// busy is true when another sync holds the config lock, so sync must exit
+func syncLocks(db *sql.DB, fn string, debug bool, env map[string]string) (lock, entryLock *syncLock, busy bool, err error) {
+	scope := gLockConfig
+	ls, ok := env["LOCK"]
+	if ok && ls != "" {
+		scope = ls
+	}
+	if scope == gLockNone {
+		return
+	}
+	if scope != gLockConfig && scope != gLockEntry {
+		err = fmt.Errorf("unknown lock scope: '%s', allowed: %s, %s, %s", scope, gLockConfig, gLockEntry, gLockNone)
+		return
+	}
+	wait := time.Duration(0)
+	lw, ok := env["LOCK_WAIT"]
+	if ok && lw != "" {
+		wait, err = time.ParseDuration(lw)
+		if err != nil {
+			return
+		}
+	}
+	key, ok := env["LOCK_KEY"]
+	if !ok || key == "" {
+		var absFn string
+		absFn, err = filepath.Abs(fn)
+		if err != nil {
+			return
+		}
+		key = "calcmetric-sync:" + absFn
+	}
+	lock, err = newSyncLock(db, key, wait, debug)
+	if err != nil {
+		return
+	}
+	if scope == gLockEntry {
+		entryLock = lock
+		return
+	}
+	locked, err := lock.acquire("")
+	if err != nil {
+		lock.release()
+		return nil, nil, false, err
+	}
+	if !locked {
+		lock.release()
+		return nil, nil, true, nil
+	}
+	return
+}
+
+// startSyncRun saves sync run history record, unless V3_NO_HISTORY is set
+func startSyncRun(db *sql.DB, fn string, env map[string]string) {
+	_, noHistory := env["NO_HISTORY"]
+	if noHistory {
+		return
+	}
+	run := &lib.SyncRun{Config: fn, StartedAt: time.Now()}
+	err := lib.StartSyncRun(context.Background(), db, run)
+	if err != nil {
+		lib.Logf("error saving sync run history, history will not be saved: %+v\n", err)
+		return
+	}
+	lib.Logf("sync run #%d\n", run.ID)
+	gSyncRun = run
+}
+
+// finishSyncRun updates sync run history record with its outcome
+func finishSyncRun(db *sql.DB, err error) {
+	if gSyncRun == nil {
+		return
+	}
+	run := gSyncRun
+	run.FinishedAt = time.Now()
+	switch {
+	case err != nil:
+		run.Status, run.Error = lib.StatusFailed, err.Error()
+	case gExitCode == 0:
+		run.Status = lib.StatusOK
+	case gExitCode == lib.TimeoutExitCode:
+		run.Status = lib.StatusTimeout
+	case gExitCode > 128:
+		run.Status = lib.StatusAborted
+	default:
+		run.Status = lib.StatusFailed
+	}
+	hErr := lib.FinishSyncRun(context.Background(), db, *run)
+	if hErr != nil {
+		lib.Logf("error saving sync run history: %+v\n", hErr)
+	}
+}
+
+func sync() (err error) {
+	gSlugsMap = make(map[string][]string)
+	env := lib.EnvMap(gPrefix)
 	_, debug := env["DEBUG"]
 	if debug {
 		lib.Logf("map: %+v\n", env)
@@ -692,7 +2000,35 @@ func sync() error {
 	if debug {
 		lib.Logf("metrics: %+v\n", metrics)
 	}
-	err = runTasks(db, metrics, debug, env)
+	err = checkDependencies(metrics)
+	if err != nil {
+		return err
+	}
+	lock, entryLock, busy, err := syncLocks(db, fn, debug, env)
+	if err != nil {
+		return err
+	}
+	if busy {
+		lib.Logf("another sync is running '%s', exiting\n", fn)
+		return nil
+	}
+	if lock != nil {
+		defer lock.release()
+	}
+	startSyncRun(db, fn, env)
+	defer func() { finishSyncRun(db, err) }()
+	_, dryRun := env["DRY_RUN"]
+	if !dryRun {
+		_, err = lib.SweepSlices(context.Background(), db, debug)
+		if err != nil {
+			lib.Logf("error dropping slices tables left behind by crashed calculations: %+v\n", err)
+		}
+	}
+	var lockLost <-chan struct{}
+	if lock != nil {
+		lockLost = lock.lost
+	}
+	err = runTasks(db, metrics, entryLock, lockLost, debug, env)
 	if err != nil {
 		return err
 	}
@@ -704,7 +2040,11 @@ func main() {
 	err := sync()
 	if err != nil {
 		lib.Logf("sync error: %+v\n", err)
+		gExitCode = 1
 	}
 	dtEnd := time.Now()
-	lib.Logf("time: %v\n", dtEnd.Sub(dtStart))
+	lib.Logf("time: %v, exit code: %d\n", dtEnd.Sub(dtStart), gExitCode)
+	if gExitCode != 0 {
+		os.Exit(gExitCode)
+	}
 }
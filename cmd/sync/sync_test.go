@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	snc "sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	lib "github.com/lukaszgryglicki/calcmetric"
+)
+
+func TestBackfillWindows(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	newYork, _ := time.LoadLocation("America/New_York")
+	warsaw, _ := time.LoadLocation("Europe/Warsaw")
+	testCases := []struct {
+		name     string
+		bf       Backfill
+		now      time.Time
+		expected [][2]string
+	}{
+		{
+			name:     "daily utc",
+			bf:       Backfill{From: "2026-10-15", Step: "daily"},
+			now:      time.Date(2026, 10, 18, 0, 30, 0, 0, time.UTC),
+			expected: [][2]string{{"2026-10-15", "2026-10-16"}, {"2026-10-16", "2026-10-17"}, {"2026-10-17", "2026-10-18"}},
+		},
+		{
+			// 2026-10-17 15:30 UTC
+			name:     "daily tokyo",
+			bf:       Backfill{From: "2026-10-15", Step: "daily"},
+			now:      time.Date(2026, 10, 18, 0, 30, 0, 0, tokyo),
+			expected: [][2]string{{"2026-10-15", "2026-10-16"}, {"2026-10-16", "2026-10-17"}, {"2026-10-17", "2026-10-18"}},
+		},
+		{
+			// 2026-10-18 02:00 UTC
+			name:     "daily new york",
+			bf:       Backfill{From: "2026-10-15", Step: "daily"},
+			now:      time.Date(2026, 10, 17, 22, 0, 0, 0, newYork),
+			expected: [][2]string{{"2026-10-15", "2026-10-16"}, {"2026-10-16", "2026-10-17"}},
+		},
+		{
+			// just after DST change
+			name:     "daily warsaw dst",
+			bf:       Backfill{From: "2026-10-24", Step: "daily"},
+			now:      time.Date(2026, 10, 26, 0, 30, 0, 0, warsaw),
+			expected: [][2]string{{"2026-10-24", "2026-10-25"}, {"2026-10-25", "2026-10-26"}},
+		},
+		{
+			name:     "weekly tokyo",
+			bf:       Backfill{From: "2026-09-28", Step: "weekly"},
+			now:      time.Date(2026, 10, 19, 0, 30, 0, 0, tokyo),
+			expected: [][2]string{{"2026-09-28", "2026-10-05"}, {"2026-10-05", "2026-10-12"}, {"2026-10-12", "2026-10-19"}},
+		},
+		{
+			name:     "weekly new york",
+			bf:       Backfill{From: "2026-09-28", Step: "weekly"},
+			now:      time.Date(2026, 10, 18, 22, 0, 0, 0, newYork),
+			expected: [][2]string{{"2026-09-28", "2026-10-05"}, {"2026-10-05", "2026-10-12"}},
+		},
+		{
+			name:     "weekly rolling tokyo",
+			bf:       Backfill{From: "2026-10-05", Step: "weekly", Mode: "rolling", Window: 2},
+			now:      time.Date(2026, 10, 26, 0, 30, 0, 0, tokyo),
+			expected: [][2]string{{"2026-10-05", "2026-10-19"}, {"2026-10-12", "2026-10-26"}},
+		},
+		{
+			name:     "monthly tokyo",
+			bf:       Backfill{From: "2026-07-01", Step: "monthly"},
+			now:      time.Date(2026, 10, 1, 0, 30, 0, 0, tokyo),
+			expected: [][2]string{{"2026-07-01", "2026-08-01"}, {"2026-08-01", "2026-09-01"}, {"2026-09-01", "2026-10-01"}},
+		},
+		{
+			name:     "monthly new york",
+			bf:       Backfill{From: "2026-07-01", Step: "monthly"},
+			now:      time.Date(2026, 9, 30, 22, 0, 0, 0, newYork),
+			expected: [][2]string{{"2026-07-01", "2026-08-01"}, {"2026-08-01", "2026-09-01"}},
+		},
+		{
+			name:     "monthly 31st",
+			bf:       Backfill{From: "2026-01-31", Step: "monthly", To: "2026-05-01"},
+			now:      time.Date(2026, 10, 1, 0, 30, 0, 0, tokyo),
+			expected: [][2]string{{"2026-01-31", "2026-02-28"}, {"2026-02-28", "2026-03-31"}, {"2026-03-31", "2026-04-30"}},
+		},
+	}
+	for _, tc := range testCases {
+		windows, err := tc.bf.windows(tc.now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		got := [][2]string{}
+		for _, w := range windows {
+			if w.timeRange != "c" {
+				t.Errorf("%s: expected custom time range, got '%s'", tc.name, w.timeRange)
+			}
+			got = append(got, [2]string{w.dateFrom, w.dateTo})
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestEntryLocation(t *testing.T) {
+	loc, err := entryLocation(map[string]string{"TZ": "Asia/Tokyo"}, map[string]string{gPrefix + "TZ": "Europe/Warsaw"})
+	if err != nil || loc.String() != "Europe/Warsaw" {
+		t.Errorf("expected entry time zone, got %v, %v", loc, err)
+	}
+	loc, err = entryLocation(map[string]string{"TZ": "Asia/Tokyo"}, map[string]string{})
+	if err != nil || loc.String() != "Asia/Tokyo" {
+		t.Errorf("expected sync time zone, got %v, %v", loc, err)
+	}
+	loc, err = entryLocation(map[string]string{}, map[string]string{})
+	if err != nil || loc != time.Local {
+		t.Errorf("expected local time zone, got %v, %v", loc, err)
+	}
+	_, err = entryLocation(map[string]string{}, map[string]string{gPrefix + "TZ": "Nowhere/Special"})
+	if err == nil {
+		t.Errorf("expected error for unknown time zone")
+	}
+}
+
+func TestSetSliceThreads(t *testing.T) {
+	tasks := []map[string]string{{}, {gPrefix + "SLICE_THREADS": "3"}}
+	setSliceThreads(tasks, runtime.NumCPU()*2, map[string]string{})
+	if tasks[0][gPrefix+"SLICE_THREADS"] != "1" || tasks[1][gPrefix+"SLICE_THREADS"] != "3" {
+		t.Errorf("unexpected slice threads: %+v", tasks)
+	}
+	tasks = []map[string]string{{}}
+	setSliceThreads(tasks, 1, map[string]string{})
+	if tasks[0][gPrefix+"SLICE_THREADS"] != strconv.Itoa(runtime.NumCPU()) {
+		t.Errorf("unexpected slice threads: %+v", tasks)
+	}
+	tasks = []map[string]string{{}}
+	setSliceThreads(tasks, 4, map[string]string{"SLICE_THREADS": "8"})
+	_, ok := tasks[0][gPrefix+"SLICE_THREADS"]
+	if ok {
+		t.Errorf("V3_SLICE_THREADS should not be overridden: %+v", tasks)
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	testCases := []struct {
+		name string
+		deps map[string][]string
+		err  string
+	}{
+		{name: "no dependencies", deps: map[string][]string{"a": nil, "b": nil}},
+		{name: "chain", deps: map[string][]string{"a": nil, "b": {"a"}, "c": {"b", "a"}}},
+		{name: "unknown", deps: map[string][]string{"a": nil, "b": {"x"}}, err: "entry 'b' depends on unknown entry 'x'"},
+		{name: "self", deps: map[string][]string{"a": {"a"}}, err: "entries dependency cycle: a -> a"},
+		{name: "cycle", deps: map[string][]string{"a": {"c"}, "b": {"a"}, "c": {"b"}, "d": nil}, err: "entries dependency cycle: a -> c -> b -> a"},
+	}
+	for _, tc := range testCases {
+		metrics := Metrics{Metrics: map[string]Metric{}}
+		for name, deps := range tc.deps {
+			metrics.Metrics[name] = Metric{DependsOn: deps}
+		}
+		err := checkDependencies(metrics)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s: expected error '%s', got: %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+// graphTask returns sync task of entry for project slug and time range
+func graphTask(entry, slug, timeRange string) map[string]string {
+	return map[string]string{
+		"TASK_NAME":               entry + ":table:metric",
+		gPrefix + "PROJECT_SLUG":  slug,
+		gPrefix + "TIME_RANGE":    timeRange,
+		gPrefix + "METRIC":        "metric",
+		gPrefix + "TABLE":         "table",
+		gPrefix + "SLICE_THREADS": "1",
+	}
+}
+
+// graphRun runs all ready tasks, tasks from failed fail, returns started and blocked tasks in order
+func graphRun(g *taskGraph, failed map[int]bool) ([]int, []int) {
+	started, blocked := []int{}, []int{}
+	for {
+		idx, ok := g.next()
+		if !ok {
+			break
+		}
+		started = append(started, idx)
+		res := taskResult{idx: idx}
+		if failed[idx] {
+			res.err = errors.New("failed")
+		}
+		for _, r := range g.finish(res) {
+			blocked = append(blocked, r.idx)
+		}
+	}
+	return started, blocked
+}
+
+func TestTaskGraph(t *testing.T) {
+	metrics := Metrics{Metrics: map[string]Metric{
+		"base":   {},
+		"mid":    {DependsOn: []string{"base"}},
+		"top":    {DependsOn: []string{"mid"}},
+		"other":  {},
+		"joined": {DependsOn: []string{"base", "other"}},
+	}}
+	tasks := []map[string]string{
+		graphTask("top", "k8s", "7d"),     // 0
+		graphTask("mid", "k8s", "7d"),     // 1
+		graphTask("base", "k8s", "7d"),    // 2
+		graphTask("base", "k8s", "30d"),   // 3
+		graphTask("mid", "k8s", "30d"),    // 4
+		graphTask("mid", "envoy", "7d"),   // 5, base has no such task, so it doesn't wait
+		graphTask("other", "k8s", "7d"),   // 6
+		graphTask("joined", "k8s", "7d"),  // 7
+		graphTask("joined", "k8s", "30d"), // 8, other has no such task
+	}
+	testCases := []struct {
+		name    string
+		failed  map[int]bool
+		locked  []string
+		started []int
+		blocked []int
+	}{
+		{
+			name:    "all succeed",
+			started: []int{2, 1, 0, 3, 4, 5, 6, 7, 8},
+			blocked: []int{},
+		},
+		{
+			name:    "failure blocks dependents transitively",
+			failed:  map[int]bool{2: true},
+			started: []int{2, 3, 4, 5, 6, 8},
+			blocked: []int{1, 0, 7},
+		},
+		{
+			name:    "failure of a middle task",
+			failed:  map[int]bool{1: true},
+			started: []int{2, 1, 3, 4, 5, 6, 7, 8},
+			blocked: []int{0},
+		},
+		{
+			name:    "one of two dependencies failed",
+			failed:  map[int]bool{6: true},
+			started: []int{2, 1, 0, 3, 4, 5, 6, 8},
+			blocked: []int{7},
+		},
+		{
+			name:    "locked entry blocks all dependents",
+			locked:  []string{"other"},
+			started: []int{2, 1, 0, 3, 4, 5, 6},
+			blocked: []int{7, 8},
+		},
+		{
+			name:    "locked entry blocks dependents transitively",
+			locked:  []string{"base"},
+			started: []int{2, 3, 6},
+			blocked: []int{0, 1, 4, 5, 7, 8},
+		},
+	}
+	for _, tc := range testCases {
+		locked := make(map[string]struct{})
+		for _, entry := range tc.locked {
+			locked[entry] = struct{}{}
+		}
+		g, initial := newTaskGraph(tasks, metrics, locked)
+		blocked := []int{}
+		for _, r := range initial {
+			if !r.blocked || r.err == nil {
+				t.Errorf("%s: task #%d should be blocked with an error: %+v", tc.name, r.idx, r)
+			}
+			blocked = append(blocked, r.idx)
+		}
+		started, runBlocked := graphRun(g, tc.failed)
+		blocked = append(blocked, runBlocked...)
+		sort.Ints(blocked)
+		expectedBlocked := append([]int{}, tc.blocked...)
+		sort.Ints(expectedBlocked)
+		if !reflect.DeepEqual(started, tc.started) {
+			t.Errorf("%s: expected started %v, got %v", tc.name, tc.started, started)
+		}
+		if !reflect.DeepEqual(blocked, expectedBlocked) {
+			t.Errorf("%s: expected blocked %v, got %v", tc.name, expectedBlocked, blocked)
+		}
+	}
+}
+
+func TestTaskDurationKey(t *testing.T) {
+	task := graphTask("entry", "k8s", "c")
+	task[gPrefix+"DATE_FROM"], task[gPrefix+"DATE_TO"] = "2023-01-01", "2023-02-01"
+	other := graphTask("entry", "k8s", "c")
+	other[gPrefix+"DATE_FROM"], other[gPrefix+"DATE_TO"] = "2023-02-01", "2023-03-01"
+	testCases := []struct {
+		task     map[string]string
+		expected string
+	}{
+		{task: graphTask("entry", "k8s", "7d"), expected: "entry:table:metric|k8s|7d"},
+		{task: task, expected: "entry:table:metric|k8s|c:2023-01-01:2023-02-01"},
+		{task: other, expected: "entry:table:metric|k8s|c:2023-02-01:2023-03-01"},
+	}
+	for _, tc := range testCases {
+		got := taskDurationKey(tc.task)
+		if got != tc.expected {
+			t.Errorf("expected '%s', got '%s'", tc.expected, got)
+		}
+	}
+}
+
+// exitError returns error of a subprocess that exited with code
+func exitError(t *testing.T, code int) error {
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != code {
+		t.Fatalf("cannot get exit code %d error, got: %v", code, err)
+	}
+	return err
+}
+
+func TestIsRetriable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "failure", err: exitError(t, 1), expected: true},
+		{name: "timeout", err: exitError(t, lib.TimeoutExitCode), expected: true},
+		{name: "fatal", err: exitError(t, lib.FatalExitCode), expected: false},
+		{name: "wrapped fatal", err: fmt.Errorf("calcmetric: %w", exitError(t, lib.FatalExitCode)), expected: false},
+		{name: "in-process deadlock", err: &pq.Error{Code: "40P01"}, expected: true},
+		{name: "in-process syntax error", err: &pq.Error{Code: "42601"}, expected: false},
+		{name: "cancelled", err: context.Canceled, expected: false},
+	}
+	for _, tc := range testCases {
+		got := isRetriable(tc.err)
+		if got != tc.expected {
+			t.Errorf("%s: expected %v, got %v for: %v", tc.name, tc.expected, got, tc.err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		policy retryPolicy
+		retry  int
+		delay  time.Duration // delay before jitter, backoff is between half of it and it
+	}{
+		{policy: retryPolicy{delay: 5 * time.Second, maxDelay: 5 * time.Minute}, retry: 1, delay: 5 * time.Second},
+		{policy: retryPolicy{delay: 5 * time.Second, maxDelay: 5 * time.Minute}, retry: 2, delay: 10 * time.Second},
+		{policy: retryPolicy{delay: 5 * time.Second, maxDelay: 5 * time.Minute}, retry: 4, delay: 40 * time.Second},
+		{policy: retryPolicy{delay: 5 * time.Second, maxDelay: 5 * time.Minute}, retry: 7, delay: 5 * time.Minute},
+		{policy: retryPolicy{delay: 5 * time.Second, maxDelay: 5 * time.Minute}, retry: 100, delay: 5 * time.Minute},
+		{policy: retryPolicy{delay: time.Minute, maxDelay: 10 * time.Second}, retry: 1, delay: 10 * time.Second},
+		{policy: retryPolicy{delay: 0, maxDelay: 5 * time.Minute}, retry: 3, delay: 0},
+	}
+	for _, tc := range testCases {
+		for i := 0; i < 1000; i++ {
+			got := tc.policy.backoff(tc.retry)
+			if got < tc.delay/2 || got > tc.delay || got > tc.policy.maxDelay {
+				t.Errorf("%+v retry #%d: expected backoff between %v and %v, got %v", tc.policy, tc.retry, tc.delay/2, tc.delay, got)
+				break
+			}
+		}
+	}
+}
+
+func TestProcessTaskRetryInterrupted(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "calcmetric")
+	err := os.WriteFile(bin, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gMtx = &snc.Mutex{}
+	gProcessing = make(map[int]map[string]string)
+	gTaskIndices = make(map[string]map[int]struct{})
+	retry := retryPolicy{retries: 3, delay: time.Hour, maxDelay: time.Hour}
+	tasks := []map[string]string{graphTask("entry", "k8s", "7d")}
+
+	// sync stopped (SIGTERM/SIGINT or lost lock) while task waits for a retry
+	stop := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stop) })
+	res := processTask(context.Background(), stop, nil, nil, 0, retry, false, false, bin, map[string]string{}, tasks)
+	if !res.aborted || res.timeout || !errors.Is(res.err, context.Canceled) {
+		t.Errorf("stopped: expected aborted task, got: %+v", res)
+	}
+	if res.took > time.Minute {
+		t.Errorf("stopped: task should not wait for its retry, took %v", res.took)
+	}
+
+	// sync deadline exceeded while task waits for a retry
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res = processTask(ctx, make(chan struct{}), nil, nil, 0, retry, false, false, bin, map[string]string{}, tasks)
+	if res.aborted || !res.timeout || !lib.IsTimeout(res.err) {
+		t.Errorf("deadline: expected timed out task, got: %+v", res)
+	}
+	if res.took > time.Minute {
+		t.Errorf("deadline: task should not wait for its retry, took %v", res.took)
+	}
+	// failed, timed out and aborted tasks are not running anymore
+	if len(gProcessing) != 0 {
+		t.Errorf("expected no running tasks, got %v", gProcessing)
+	}
+}
+
+func TestDurationSample(t *testing.T) {
+	// stored duration of a long task, averaged like metric_task_duration does
+	stored := 3600.0
+	runs := []struct {
+		result taskResult
+		took   time.Duration
+	}{
+		{result: taskResult{skipped: true}, took: 10 * time.Millisecond},
+		{result: taskResult{skipped: true}, took: 20 * time.Millisecond},
+		{result: taskResult{skipped: true}, took: time.Second},
+	}
+	for _, run := range runs {
+		took, ok := durationSample(run.result, run.took)
+		if ok {
+			stored = (stored + took.Seconds()) / 2
+		}
+	}
+	if stored != 3600.0 {
+		t.Errorf("skipped runs should leave stored duration unchanged, got %.2fs", stored)
+	}
+	took, ok := durationSample(taskResult{rows: 100}, 3000*time.Second)
+	if !ok || took != 3000*time.Second {
+		t.Errorf("calculated run should be recorded, got %v, %v", took, ok)
+	}
+}
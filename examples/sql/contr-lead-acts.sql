@@ -30,7 +30,7 @@ where
   and a.deletedAt is null
   and a.timestamp >= {{date_from}}
   and a.timestamp < {{date_to}}
-  and m.is_bot {{is_bot}}
+  and m.is_bot {{is_bot:raw}}
   and p.project_slug = '{{project_slug}}'
 group by
   m.logo_url,
@@ -0,0 +1,32 @@
+-- ---
+-- description: number of contributors and contributions per bucket (time-series)
+-- bucket: week
+-- params:
+--   tenant_id: {required: true, description: tenant UUID}
+--   is_bot: {default: '!= true', description: condition on member's is_bot flag}
+-- ---
+select
+  date_trunc({{bucket}}, a.timestamp)::date as bucket_start,
+  count(distinct (a.memberId, a.platform, a.username)) as contributors,
+  count(distinct a.id) as contributions
+from
+  activities a
+join
+  mv_members m
+on
+  a.memberId = m.id
+join
+  mv_subprojects p
+on
+  a.segmentId = p.id
+where
+  a.tenantId = {{tenant_id}}
+  and a.deletedAt is null
+  and a.timestamp >= {{date_from}}
+  and a.timestamp < {{date_to}}
+  and m.is_bot {{is_bot:raw}}
+  and p.project_slug = '{{project_slug}}'
+group by
+  bucket_start
+order by
+  bucket_start
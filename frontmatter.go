@@ -0,0 +1,155 @@
+package calcmetric
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Front-matter is a YAML document at the very top of metric SQL file, each line commented out with "--"
+// and the whole block surrounded with "-- ---" lines, for example:
+// -- ---
+// -- description: contributors leaderboard
+// -- limit: 200
+// -- params:
+// --   tenant_id: {required: true, description: tenant UUID}
+// -- ---
+const gFrontMatterMarker = "---"
+
+var gIdentifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// metricParam - metric SQL placeholder declared in front-matter
+type metricParam struct {
+	Default     string `yaml:"default"`     // used when V3_PARAM_name is not specified
+	Required    bool   `yaml:"required"`    // fail if V3_PARAM_name is not specified and there is no default
+	Description string `yaml:"description"` // documentation only
+}
+
+// metricHeader - metric SQL front-matter, all values can be overridden by V3_ environment variables or calculations.yaml
+type metricHeader struct {
+	Description     string                 `yaml:"description"`       // documentation only
+	Params          map[string]metricParam `yaml:"params"`            // V3_PARAM_name defaults
+	Limit           string                 `yaml:"limit"`             // V3_LIMIT default
+	Offset          string                 `yaml:"offset"`            // V3_OFFSET default
+	IndexedColumns  []string               `yaml:"indexed_columns"`   // V3_INDEXED_COLUMNS default
+	ColumnTypes     map[string]string      `yaml:"column_types"`      // same as "-- column: name type" lines
+	PrimaryKey      []string               `yaml:"primary_key"`       // V3_PRIMARY_KEY default
+	TimeRanges      []string               `yaml:"time_ranges"`       // time ranges this metric can be calculated for, all if empty
+	WeekStart       string                 `yaml:"week_start"`        // V3_WEEK_START default
+	FiscalYearStart string                 `yaml:"fiscal_year_start"` // V3_FISCAL_YEAR_START default
+	Bucket          string                 `yaml:"bucket"`            // V3_BUCKET default, time-series metrics
+	Slice           string                 `yaml:"slice"`             // V3_SLICE default, additive metrics only
+	Reduce          string                 `yaml:"reduce"`            // SQL combining slices from {{slices}} table, declares metric as additive
+}
+
+// parseMetricHeader - returns front-matter from metric SQL and the SQL without it
+func parseMetricHeader(contents string) (metricHeader, string, error) {
+	var hdr metricHeader
+	lines := strings.Split(contents, "\n")
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+	if start >= len(lines) || !isFrontMatterMarker(lines[start]) {
+		return hdr, contents, nil
+	}
+	yml := []string{}
+	for i := start + 1; i < len(lines); i++ {
+		if isFrontMatterMarker(lines[i]) {
+			err := yaml.Unmarshal([]byte(strings.Join(yml, "\n")), &hdr)
+			if err != nil {
+				return hdr, contents, fmt.Errorf("cannot parse metric SQL front-matter: %+v", err)
+			}
+			return hdr, strings.Join(lines[i+1:], "\n"), nil
+		}
+		line := strings.TrimRight(lines[i], " \t\r")
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			return hdr, contents, fmt.Errorf("metric SQL front-matter line %d is not a comment: '%s', front-matter must end with '-- %s' line", i+1, line, gFrontMatterMarker)
+		}
+		line = strings.TrimPrefix(strings.TrimSpace(line), "--")
+		// YAML indentation is relative to a single space after "--"
+		line = strings.TrimPrefix(line, " ")
+		yml = append(yml, line)
+	}
+	return hdr, contents, fmt.Errorf("metric SQL front-matter is not terminated with '-- %s' line", gFrontMatterMarker)
+}
+
+func isFrontMatterMarker(line string) bool {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "--") {
+		return false
+	}
+	return strings.TrimSpace(line[2:]) == gFrontMatterMarker
+}
+
+// applyMetricHeader - uses front-matter values for everything that was not specified by the caller
+func applyMetricHeader(hdr *metricHeader, c *Calculation) error {
+	if len(hdr.TimeRanges) > 0 {
+		allowed := false
+		for _, tr := range hdr.TimeRanges {
+			if strings.TrimSpace(tr) == c.TimeRange {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("metric '%s' doesn't support '%s' time range, allowed: %s", c.Metric, c.TimeRange, strings.Join(hdr.TimeRanges, ", "))
+		}
+	}
+	if c.WeekStart == "" {
+		c.WeekStart = hdr.WeekStart
+	}
+	if c.FiscalYearStart == "" {
+		c.FiscalYearStart = hdr.FiscalYearStart
+	}
+	if c.Bucket == "" {
+		c.Bucket = hdr.Bucket
+	}
+	if c.Slice == "" {
+		c.Slice = hdr.Slice
+	}
+	if c.Limit == "" {
+		c.Limit = hdr.Limit
+	}
+	if c.Offset == "" {
+		c.Offset = hdr.Offset
+	}
+	if len(c.IndexedColumns) == 0 {
+		c.IndexedColumns = hdr.IndexedColumns
+	}
+	if len(c.PrimaryKey) == 0 {
+		c.PrimaryKey = hdr.PrimaryKey
+	}
+	for _, col := range c.PrimaryKey {
+		if !gIdentifierRe.MatchString(col) {
+			return fmt.Errorf("invalid primary key column '%s'", col)
+		}
+	}
+	params := make(map[string]string)
+	missing := []string{}
+	for name, param := range hdr.Params {
+		_, ok := c.Params[name]
+		if ok {
+			continue
+		}
+		if param.Default != "" {
+			params[name] = param.Default
+			continue
+		}
+		if param.Required {
+			missing = append(missing, Prefix+"PARAM_"+name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("metric '%s' requires: %s", c.Metric, strings.Join(missing, ", "))
+	}
+	for name, value := range c.Params {
+		params[name] = value
+	}
+	c.Params = params
+	return nil
+}
@@ -0,0 +1,169 @@
+package calcmetric
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetricHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected metricHeader
+		sql      string
+		err      string
+	}{
+		{name: "no header", contents: "select 1", sql: "select 1"},
+		{name: "comment is not a header", contents: "-- contributors\nselect 1", sql: "-- contributors\nselect 1"},
+		{
+			name:     "header",
+			contents: "\n-- ---\n-- description: leaderboard\n-- limit: 200\n-- indexed_columns: [a, b]\n-- params:\n--   tenant_id: {required: true}\n--   is_bot: {default: '!= true'}\n--  ---  \nselect 1",
+			expected: metricHeader{
+				Description:    "leaderboard",
+				Limit:          "200",
+				IndexedColumns: []string{"a", "b"},
+				Params: map[string]metricParam{
+					"tenant_id": {Required: true},
+					"is_bot":    {Default: "!= true"},
+				},
+			},
+			sql: "select 1",
+		},
+		{
+			name:     "indented comments",
+			contents: "-- ---\n  --  time_ranges:\n  --    - 7d\n  --    - 30d\n-- ---\nselect 1",
+			expected: metricHeader{TimeRanges: []string{"7d", "30d"}},
+			sql:      "select 1",
+		},
+		{name: "empty header", contents: "-- ---\n-- ---\nselect 1", sql: "select 1"},
+		{name: "unterminated", contents: "-- ---\n-- limit: 10\nselect 1", err: "line 3 is not a comment: 'select 1', front-matter must end with '-- ---' line"},
+		{name: "unterminated at end", contents: "-- ---\n-- limit: 10", err: "not terminated with '-- ---' line"},
+		{name: "non-comment line", contents: "-- ---\n-- limit: 10\nlimit: 20\n-- ---\nselect 1", err: "line 3 is not a comment: 'limit: 20'"},
+		{name: "invalid yaml", contents: "-- ---\n-- limit: [10\n-- ---\nselect 1", err: "cannot parse metric SQL front-matter"},
+		{name: "invalid type", contents: "-- ---\n-- params: 10\n-- ---\nselect 1", err: "cannot parse metric SQL front-matter"},
+	}
+	for _, tc := range testCases {
+		hdr, sql, err := parseMetricHeader(tc.contents)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing '%s', got: %v", tc.name, tc.err, err)
+			}
+			if sql != tc.contents {
+				t.Errorf("%s: expected unchanged contents on error, got '%s'", tc.name, sql)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(hdr, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, hdr)
+		}
+		if sql != tc.sql {
+			t.Errorf("%s: expected SQL '%s', got '%s'", tc.name, tc.sql, sql)
+		}
+	}
+}
+
+func TestApplyMetricHeader(t *testing.T) {
+	hdr := metricHeader{
+		Limit:          "200",
+		Offset:         "10",
+		IndexedColumns: []string{"a", "b"},
+		PrimaryKey:     []string{"memberid"},
+		TimeRanges:     []string{"7d", " 30d "},
+		WeekStart:      "sunday",
+		Params: map[string]metricParam{
+			"tenant_id": {Required: true},
+			"is_bot":    {Default: "!= true"},
+			"extra":     {Description: "optional without default"},
+		},
+	}
+	testCases := []struct {
+		name     string
+		hdr      metricHeader
+		calc     Calculation
+		expected Calculation
+		err      string
+	}{
+		{
+			name: "defaults",
+			hdr:  hdr,
+			calc: Calculation{Metric: "m", TimeRange: "7d", Params: map[string]string{"tenant_id": "t1"}},
+			expected: Calculation{
+				Metric: "m", TimeRange: "7d", Limit: "200", Offset: "10", WeekStart: "sunday",
+				IndexedColumns: []string{"a", "b"}, PrimaryKey: []string{"memberid"},
+				Params: map[string]string{"tenant_id": "t1", "is_bot": "!= true"},
+			},
+		},
+		{
+			name: "overrides",
+			hdr:  hdr,
+			calc: Calculation{
+				Metric: "m", TimeRange: "30d", Limit: "5", WeekStart: "monday",
+				IndexedColumns: []string{"c"}, PrimaryKey: []string{"id", "slug"},
+				Params: map[string]string{"tenant_id": "t1", "is_bot": "= true", "extra": "x"},
+			},
+			expected: Calculation{
+				Metric: "m", TimeRange: "30d", Limit: "5", Offset: "10", WeekStart: "monday",
+				IndexedColumns: []string{"c"}, PrimaryKey: []string{"id", "slug"},
+				Params: map[string]string{"tenant_id": "t1", "is_bot": "= true", "extra": "x"},
+			},
+		},
+		{
+			name: "empty header",
+			calc: Calculation{Metric: "m", TimeRange: "q", Limit: "5"},
+			expected: Calculation{
+				Metric: "m", TimeRange: "q", Limit: "5", Params: map[string]string{},
+			},
+		},
+		{
+			name: "required param missing",
+			hdr:  hdr,
+			calc: Calculation{Metric: "m", TimeRange: "7d", Params: map[string]string{"is_bot": "= true"}},
+			err:  "metric 'm' requires: V3_PARAM_tenant_id",
+		},
+		{
+			name: "required params missing",
+			hdr:  metricHeader{Params: map[string]metricParam{"b": {Required: true}, "a": {Required: true}, "c": {Required: true, Default: "1"}}},
+			calc: Calculation{Metric: "m", TimeRange: "7d"},
+			err:  "metric 'm' requires: V3_PARAM_a, V3_PARAM_b",
+		},
+		{
+			name: "time range not allowed",
+			hdr:  hdr,
+			calc: Calculation{Metric: "m", TimeRange: "q", Params: map[string]string{"tenant_id": "t1"}},
+			err:  "metric 'm' doesn't support 'q' time range, allowed: 7d,  30d ",
+		},
+		{
+			name: "invalid primary key",
+			calc: Calculation{Metric: "m", TimeRange: "7d", PrimaryKey: []string{"id; drop table t"}},
+			err:  "invalid primary key column 'id; drop table t'",
+		},
+		{
+			name: "invalid primary key from header",
+			hdr:  metricHeader{PrimaryKey: []string{"a b"}},
+			calc: Calculation{Metric: "m", TimeRange: "7d"},
+			err:  "invalid primary key column 'a b'",
+		},
+	}
+	for _, tc := range testCases {
+		c := tc.calc
+		err := applyMetricHeader(&tc.hdr, &c)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error '%s', got: %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, c)
+		}
+	}
+}
@@ -3,6 +3,6 @@ module github.com/lukaszgryglicki/calcmetric
 go 1.20
 
 require (
-	github.com/lib/pq v1.10.9 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,229 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Run statuses saved in metric_task_run (calculations) and metric_sync_run (sync runs) tables
+const (
+	StatusCalculated = "calculated"  // calculation wrote rows
+	StatusSkipped    = "skipped"     // calculation was not needed or produced no data
+	StatusFailed     = "failed"      // calculation failed or sync run had failed tasks
+	StatusTimeout    = "timeout"     // calculation exceeded its timeout or sync run had timed out tasks
+	StatusAborted    = "aborted"     // calculation or sync run was stopped by SIGTERM/SIGINT
+	StatusBlocked    = "blocked"     // sync task was not started because a task it depends on didn't succeed
+	StatusNotStarted = "not started" // sync task was not started because sync was stopped or its deadline was exceeded
+	StatusRunning    = "running"     // sync run that is still running (or that crashed)
+	StatusOK         = "ok"          // sync run without failed tasks
+)
+
+// History tables, created when they are used for the first time
+const gCreateHistoryTables = `
+create table if not exists metric_sync_run(
+  id bigserial not null,
+  started_at timestamp not null,
+  finished_at timestamp,
+  status varchar(16) not null,
+  config text not null,
+  host text not null,
+  pid int not null,
+  tasks int,
+  calculated int,
+  skipped int,
+  failed int,
+  timed_out int,
+  aborted int,
+  blocked int,
+  not_started int,
+  rows bigint,
+  error text,
+  primary key(id)
+);
+create table if not exists metric_task_run(
+  id bigserial not null,
+  sync_run_id bigint,
+  task_name text,
+  metric text not null,
+  table_name text not null,
+  project_slug text not null,
+  time_range varchar(64) not null,
+  date_from date,
+  date_to date,
+  started_at timestamp not null,
+  finished_at timestamp not null,
+  status varchar(16) not null,
+  rows bigint,
+  attempts int not null,
+  error text,
+  primary key(id)
+);
+create index if not exists metric_task_run_window_idx on metric_task_run(table_name, project_slug, time_range, started_at);
+create index if not exists metric_task_run_sync_run_id_idx on metric_task_run(sync_run_id);
+`
+
+// SyncRun - single sync run saved in metric_sync_run table
+type SyncRun struct {
+	ID         int64  // set by StartSyncRun
+	Config     string // calculations.yaml path
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Status     string // StatusRunning until FinishSyncRun, then StatusOK, StatusFailed, StatusTimeout or StatusAborted
+	Tasks      int
+	Calculated int
+	Skipped    int
+	Failed     int
+	TimedOut   int
+	Aborted    int
+	Blocked    int
+	NotStarted int
+	Rows       int
+	Error      string
+}
+
+// TaskRun - single calculation (with all its attempts) saved in metric_task_run table
+type TaskRun struct {
+	SyncRunID   int64  // 0 when calculation was not run by sync
+	TaskName    string // sync's key:table:metric, empty when calculation was not run by sync
+	Metric      string
+	Table       string
+	ProjectSlug string
+	TimeRange   string
+	DateFrom    time.Time // zero if time range was not computed
+	DateTo      time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Status      string // StatusCalculated, StatusSkipped, StatusFailed, StatusTimeout, StatusAborted, StatusBlocked or StatusNotStarted
+	Rows        int    // -1 if unknown (calcmetric subprocess doesn't report it)
+	Attempts    int
+	Error       string
+}
+
+// NewTaskRun - returns history record of a calculation that finished with res and err
+func NewTaskRun(c Calculation, res Result, err error, startedAt time.Time, attempts int) TaskRun {
+	run := TaskRun{
+		Metric:      c.Metric,
+		Table:       res.Table,
+		ProjectSlug: c.ProjectSlug,
+		TimeRange:   c.TimeRange,
+		DateFrom:    res.DateFrom,
+		DateTo:      res.DateTo,
+		StartedAt:   startedAt,
+		FinishedAt:  time.Now(),
+		Rows:        res.Rows,
+		Attempts:    attempts,
+		Status:      StatusCalculated,
+	}
+	if run.Table == "" {
+		run.Table = c.Table
+	}
+	switch {
+	case err != nil && IsTimeout(err):
+		run.Status = StatusTimeout
+	case err != nil && errors.Is(err, context.Canceled):
+		run.Status = StatusAborted
+	case err != nil:
+		run.Status = StatusFailed
+	case !res.Calculated:
+		run.Status = StatusSkipped
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// nullable - returns nil for zero values, so they are saved as null
+func nullable(v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		if val == "" {
+			return nil
+		}
+	case int64:
+		if val == 0 {
+			return nil
+		}
+	case time.Time:
+		if val.IsZero() {
+			return nil
+		}
+	}
+	return v
+}
+
+// execHistory - executes history query, creates history tables if they don't exist yet
+func execHistory(ctx context.Context, db *sql.DB, query string, args []interface{}, dest ...interface{}) error {
+	run := func() error {
+		if len(dest) > 0 {
+			return db.QueryRowContext(ctx, query, args...).Scan(dest...)
+		}
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+	err := run()
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "undefined_table" {
+		Logf("history tables do not exist yet, creating them\n")
+		_, err = db.ExecContext(ctx, gCreateHistoryTables)
+		if err != nil {
+			QueryOut(gCreateHistoryTables, []interface{}{}...)
+			return err
+		}
+		err = run()
+	}
+	if err != nil {
+		QueryOut(query, args...)
+	}
+	return err
+}
+
+// SaveTaskRun - saves calculation history record
+func SaveTaskRun(ctx context.Context, db *sql.DB, run TaskRun) error {
+	var rows interface{}
+	if run.Rows >= 0 {
+		rows = run.Rows
+	}
+	return execHistory(
+		ctx,
+		db,
+		`insert into metric_task_run(sync_run_id, task_name, metric, table_name, project_slug, time_range, date_from, date_to,
+    started_at, finished_at, status, rows, attempts, error) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		[]interface{}{
+			nullable(run.SyncRunID), nullable(run.TaskName), run.Metric, run.Table, run.ProjectSlug, run.TimeRange, nullable(run.DateFrom), nullable(run.DateTo),
+			run.StartedAt, run.FinishedAt, run.Status, rows, run.Attempts, nullable(run.Error),
+		},
+	)
+}
+
+// StartSyncRun - saves sync run history record with StatusRunning and sets its ID
+func StartSyncRun(ctx context.Context, db *sql.DB, run *SyncRun) error {
+	host, _ := os.Hostname()
+	run.Status = StatusRunning
+	return execHistory(
+		ctx,
+		db,
+		`insert into metric_sync_run(started_at, status, config, host, pid) values ($1, $2, $3, $4, $5) returning id`,
+		[]interface{}{run.StartedAt, run.Status, run.Config, host, os.Getpid()},
+		&run.ID,
+	)
+}
+
+// FinishSyncRun - updates sync run history record with its outcome
+func FinishSyncRun(ctx context.Context, db *sql.DB, run SyncRun) error {
+	return execHistory(
+		ctx,
+		db,
+		`update metric_sync_run set finished_at = $2, status = $3, tasks = $4, calculated = $5, skipped = $6, failed = $7,
+    timed_out = $8, aborted = $9, blocked = $10, not_started = $11, rows = $12, error = $13 where id = $1`,
+		[]interface{}{
+			run.ID, run.FinishedAt, run.Status, run.Tasks, run.Calculated, run.Skipped, run.Failed,
+			run.TimedOut, run.Aborted, run.Blocked, run.NotStarted, run.Rows, nullable(run.Error),
+		},
+	)
+}
@@ -0,0 +1,454 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Loaders used to save calculated rows into the result table
+const (
+	LoaderCopy   = "copy"   // COPY rows into a temporary staging table and then merge it into the result table
+	LoaderUpsert = "upsert" // multi-row insert ... on conflict do update batches
+)
+
+// Time-series bucket granularities (V3_BUCKET), metric SQL returns one or more rows per bucket in gBucketColumn column
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+const gBucketColumn = "bucket_start"
+
+// keyColumns - columns added to every result table, first five of them (without last_calculated_at) are its primary key
+var keyColumns = []string{"time_range", "project_slug", "last_calculated_at", "date_from", "date_to", "row_number"}
+
+// primaryKey - result table primary key, time-series tables have one or more rows per bucket, so bucket_start is a part of it
+func primaryKey(c *Calculation) []string {
+	if c.Bucket == "" {
+		return []string{"time_range", "project_slug", "date_from", "date_to", "row_number"}
+	}
+	return []string{"time_range", "project_slug", "date_from", "date_to", gBucketColumn, "row_number"}
+}
+
+// checkBucket - validates time-series bucket granularity
+func checkBucket(bucket string) error {
+	switch bucket {
+	case "", BucketDay, BucketWeek, BucketMonth:
+		return nil
+	}
+	return fmt.Errorf("unknown bucket: '%s', allowed: %s, %s, %s", bucket, BucketDay, BucketWeek, BucketMonth)
+}
+
+// rowNumbers - numbers rows of a calculated window, rows of time-series tables are numbered within their bucket
+type rowNumbers struct {
+	bucket int // index of bucket_start column, -1 if not in time-series mode
+	n      int
+	counts map[string]int
+}
+
+func newRowNumbers(c *Calculation, colNames []string) *rowNumbers {
+	r := &rowNumbers{bucket: -1, counts: make(map[string]int)}
+	if c.Bucket == "" {
+		return r
+	}
+	for i, colName := range colNames {
+		if strings.ToLower(colName) == gBucketColumn {
+			r.bucket = i
+		}
+	}
+	return r
+}
+
+// next - returns row number for the scanned row
+func (r *rowNumbers) next(pValues []interface{}) int {
+	r.n++
+	if r.bucket < 0 {
+		return r.n
+	}
+	key := string(*pValues[r.bucket].(*sql.RawBytes))
+	r.counts[key]++
+	return r.counts[key]
+}
+
+// builtinColumn - other column added to every result table, its value is the same for all rows of a calculated window
+type builtinColumn struct {
+	name  string
+	ddl   string
+	value func(c *Calculation, res *Result) interface{}
+}
+
+var gBuiltinColumns = []builtinColumn{
+	{
+		name: "time_zone",
+		ddl:  "text",
+		value: func(c *Calculation, res *Result) interface{} {
+			return res.TimeZone
+		},
+	},
+	{
+		name: "bucket",
+		ddl:  "text",
+		value: func(c *Calculation, res *Result) interface{} {
+			if c.Bucket == "" {
+				return nil
+			}
+			return c.Bucket
+		},
+	},
+	{
+		name: "fiscal",
+		ddl:  "bool",
+		value: func(c *Calculation, res *Result) interface{} {
+			return res.Fiscal
+		},
+	},
+	{
+		name: "iso_year",
+		ddl:  "int",
+		value: func(c *Calculation, res *Result) interface{} {
+			if !isISOWeekRange(c.TimeRange) {
+				return nil
+			}
+			year, _ := res.DateFrom.ISOWeek()
+			return year
+		},
+	},
+	{
+		name: "iso_week",
+		ddl:  "int",
+		value: func(c *Calculation, res *Result) interface{} {
+			if !isISOWeekRange(c.TimeRange) {
+				return nil
+			}
+			_, week := res.DateFrom.ISOWeek()
+			return week
+		},
+	},
+}
+
+// fixedColumns - names of key and built-in columns, in the order used by rowKey
+func fixedColumns() []string {
+	columns := append([]string{}, keyColumns...)
+	for _, col := range gBuiltinColumns {
+		columns = append(columns, col.name)
+	}
+	return columns
+}
+
+// checkColumnNames - fails if metric returns a column with the same name as a key or built-in column
+// Postgres folds unquoted names to lower case, so names are compared case insensitive
+func checkColumnNames(metric string, colNames []string) error {
+	fixed := make(map[string]struct{})
+	for _, col := range fixedColumns() {
+		fixed[col] = struct{}{}
+	}
+	for _, colName := range colNames {
+		_, ok := fixed[strings.ToLower(colName)]
+		if ok {
+			return fmt.Errorf("metric '%s' returns '%s' column, which collides with a column added to every result table (%s), rename it", metric, colName, strings.Join(fixedColumns(), ", "))
+		}
+	}
+	return nil
+}
+
+// builtinValues - values of built-in columns for the current calculation
+func builtinValues(c *Calculation, res *Result) []interface{} {
+	values := []interface{}{}
+	for _, col := range gBuiltinColumns {
+		values = append(values, col.value(c, res))
+	}
+	return values
+}
+
+// rowKey - values of key and built-in columns for a row with rowNumber
+func rowKey(c *Calculation, calcDt, dtf, dtt time.Time, rowNumber int, builtin []interface{}) []interface{} {
+	return append([]interface{}{c.TimeRange, c.ProjectSlug, calcDt, dtf, dtt, rowNumber}, builtin...)
+}
+
+// rowValue - returns value to save for a scanned raw column, NULLs are kept as NULLs
+func rowValue(pValue interface{}) interface{} {
+	raw := *pValue.(*sql.RawBytes)
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+// upsertSet - returns on conflict clause updating all metric columns
+// "(b, c) = (excluded.b, excluded.c)" or "b = excluded.b" for a single column
+func upsertSet(c *Calculation, colNames []string) string {
+	excluded := []string{}
+	for _, colName := range colNames {
+		excluded = append(excluded, "excluded."+colName)
+	}
+	query := " on conflict(" + strings.Join(primaryKey(c), ", ") + ") do update set "
+	if len(colNames) > 1 {
+		return query + "(" + strings.Join(colNames, ", ") + ") = (" + strings.Join(excluded, ", ") + ")"
+	}
+	return query + colNames[0] + " = " + excluded[0]
+}
+
+// deleteWindow - deletes all previously calculated rows for the current window, it runs in the same transaction
+// as the insert of new rows, so readers always see either the old or the new snapshot
+// Fiscal and calendar windows are different windows, see isCalculated
+func deleteWindow(ctx context.Context, tx *sql.Tx, table string, c *Calculation, dtf, dtt time.Time, fiscal bool) (int64, error) {
+	delQuery := fmt.Sprintf(
+		`delete from "%s" where time_range = $1 and project_slug = $2 and date_from = $3 and date_to = $4 and coalesce(fiscal, false) = $5`,
+		table,
+	)
+	args := []interface{}{c.TimeRange, c.ProjectSlug, dtf, dtt, fiscal}
+	if c.Debug {
+		Logf("delete window:\n%s\n%+v\n", delQuery, args)
+	}
+	rslt, err := tx.ExecContext(ctx, delQuery, args...)
+	if err != nil {
+		QueryOut(delQuery, args...)
+		return 0, err
+	}
+	return rslt.RowsAffected()
+}
+
+func loadCopy(ctx context.Context, db *sql.DB, rows *sql.Rows, table string, colNames []string, dtf, dtt time.Time, c *Calculation, res *Result) (err error) {
+	debug := c.Debug
+	nColumns := len(colNames)
+	pValues := make([]interface{}, nColumns)
+	for i := range colNames {
+		pValues[i] = new(sql.RawBytes)
+	}
+	calcDt := time.Now()
+	staging := "stg_" + table
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	err = setSession(ctx, tx, c, res, false)
+	if err != nil {
+		return err
+	}
+	createStaging := fmt.Sprintf(`create temp table "%s" (like "%s" including defaults) on commit drop`, staging, table)
+	if debug {
+		Logf("create staging table:\n%s\n", createStaging)
+	}
+	_, err = tx.ExecContext(ctx, createStaging)
+	if err != nil {
+		QueryOut(createStaging, []interface{}{}...)
+		return err
+	}
+	builtin := builtinValues(c, res)
+	allColumns := append(fixedColumns(), colNames...)
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(staging, allColumns...))
+	if err != nil {
+		return err
+	}
+	i := 0
+	numbers := newRowNumbers(c, colNames)
+	dtCopy := time.Now()
+	for rows.Next() {
+		err = rows.Scan(pValues...)
+		if err != nil {
+			_ = stmt.Close()
+			return err
+		}
+		i++
+		args := rowKey(c, calcDt, dtf, dtt, numbers.next(pValues), builtin)
+		for _, pValue := range pValues {
+			args = append(args, rowValue(pValue))
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+		if err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = stmt.Close()
+		return err
+	}
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		_ = stmt.Close()
+		return err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return err
+	}
+	copyTook := time.Now().Sub(dtCopy)
+	dtMerge := time.Now()
+	deleted, err := deleteWindow(ctx, tx, table, c, dtf, dtt, res.Fiscal)
+	if err != nil {
+		return err
+	}
+	var nRows int64
+	if i > 0 {
+		columns := strings.Join(allColumns, ", ")
+		merge := fmt.Sprintf(`insert into "%s"(%s) select %s from "%s"`, table, columns, columns, staging) + upsertSet(c, colNames)
+		if debug {
+			Logf("merge:\n%s\n", merge)
+		}
+		var rslt sql.Result
+		rslt, err = tx.ExecContext(ctx, merge)
+		if err != nil {
+			QueryOut(merge, []interface{}{}...)
+			return err
+		}
+		nRows, err = rslt.RowsAffected()
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	res.Calculated = nRows > 0 || deleted > 0
+	res.Rows = i
+	Logf("copied %d rows in %v, replaced %d old rows with %d new rows in %v\n", i, copyTook, deleted, nRows, time.Now().Sub(dtMerge))
+	return nil
+}
+
+func loadUpsert(ctx context.Context, db *sql.DB, rows *sql.Rows, table string, colNames []string, dtf, dtt time.Time, c *Calculation, res *Result) (err error) {
+	debug := c.Debug
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	err = setSession(ctx, tx, c, res, false)
+	if err != nil {
+		return err
+	}
+	deleted, err := deleteWindow(ctx, tx, table, c, dtf, dtt, res.Fiscal)
+	if err != nil {
+		return err
+	}
+	i := 0
+	nColumns := len(colNames)
+	l := nColumns - 1
+	pValues := make([]interface{}, nColumns)
+	for i := range colNames {
+		pValues[i] = new(sql.RawBytes)
+	}
+	calcDt := time.Now()
+	p := 0
+	ep := 0
+	changes := deleted > 0
+	// This is the type of query that we will be using (UPSERT):
+	// insert into t(a, b, c) values (1, 2, 30), (4, 5, 60) on conflict(a, b) do update set (b, c) = (excluded.b, excluded.c);
+	builtin := builtinValues(c, res)
+	numbers := newRowNumbers(c, colNames)
+	fixed := fixedColumns()
+	nFixed := len(fixed)
+	queryRoot := fmt.Sprintf(`insert into "%s"(%s, `, table, strings.Join(fixed, ", "))
+	query := ""
+	args := []interface{}{}
+	batches := 0
+	flush := func(final bool) error {
+		query += upsertSet(c, colNames)
+		if debug {
+			if final {
+				Logf("final flush at %d\n", p)
+			} else {
+				Logf("flush at %d\n", p)
+			}
+			Logf("query:\n%s\n", query)
+			Logf("args(%d):\n%+v\n", len(args), args)
+		}
+		rslt, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			QueryOut(query, args...)
+			return err
+		}
+		nRows, err := rslt.RowsAffected()
+		if err != nil {
+			QueryOut(query, args...)
+			return err
+		}
+		if !changes && nRows > 0 {
+			changes = true
+		}
+		query = ""
+		args = []interface{}{}
+		p = 0
+		batches++
+		return nil
+	}
+	for rows.Next() {
+		err = rows.Scan(pValues...)
+		if err != nil {
+			return err
+		}
+		i++
+		args = append(args, rowKey(c, calcDt, dtf, dtt, numbers.next(pValues), builtin)...)
+		for _, pValue := range pValues {
+			args = append(args, rowValue(pValue))
+		}
+		if ep == 0 {
+			ep = len(pValues)
+		}
+		if query == "" {
+			query = queryRoot
+			for j, colName := range colNames {
+				query += colName
+				if j < l {
+					query += ", "
+				}
+			}
+			query += ") values ("
+		} else {
+			query += ", ("
+		}
+		for j := 0; j < nFixed; j++ {
+			query += fmt.Sprintf("$%d, ", p+j+1)
+		}
+		for j := range colNames {
+			query += fmt.Sprintf("$%d", p+j+nFixed+1)
+			if j < l {
+				query += ", "
+			}
+		}
+		query += ")"
+		p += nFixed + ep
+		if p >= gMaxPlaceholders-(nFixed+ep) {
+			err = flush(false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(args) > 0 {
+		err = flush(true)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	res.Calculated = changes
+	res.Rows = i
+	res.Batches = batches
+	Logf("completed in %d batches, replaced %d old rows\n", batches, deleted)
+	return nil
+}
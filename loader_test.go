@@ -0,0 +1,56 @@
+package calcmetric
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckColumnNames(t *testing.T) {
+	testCases := []struct {
+		colNames []string
+		err      string
+	}{
+		{colNames: []string{"memberid", "contributions", "bucket_start"}},
+		{colNames: []string{"memberid", "time_zone"}, err: "'time_zone' column"},
+		{colNames: []string{"Bucket", "memberid"}, err: "'Bucket' column"},
+		{colNames: []string{"fiscal"}, err: "'fiscal' column"},
+		{colNames: []string{"row_number"}, err: "'row_number' column"},
+		{colNames: []string{"project_slug"}, err: "'project_slug' column"},
+		{colNames: []string{"iso_year", "iso_week"}, err: "'iso_year' column"},
+		{colNames: []string{"memberid", "ISO_WEEK"}, err: "'ISO_WEEK' column"},
+	}
+	for _, tc := range testCases {
+		err := checkColumnNames("m", tc.colNames)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", tc.colNames, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error containing '%s', got: %v", tc.colNames, tc.err, err)
+		}
+	}
+}
+
+func TestColumnTypesCollisions(t *testing.T) {
+	tmpl := "-- column: memberid uuid\nselect memberid, cnt from t"
+	_, err := columnTypes(tmpl, map[string]string{"cnt": "bigint"}, &Calculation{Metric: "m", ColumnTypes: map[string]string{"Name": "text"}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, c := range []struct {
+		tmpl     string
+		hdrTypes map[string]string
+		types    map[string]string
+	}{
+		{tmpl: "-- column: iso_week int\nselect 1 as iso_week"},
+		{tmpl: "select 1 as iso_year", hdrTypes: map[string]string{"iso_year": "int"}},
+		{tmpl: "select 1 as iso_week", types: map[string]string{"ISO_WEEK": "bigint"}},
+	} {
+		_, err := columnTypes(c.tmpl, c.hdrTypes, &Calculation{Metric: "m", ColumnTypes: c.types})
+		if err == nil || !strings.Contains(err.Error(), "collides") {
+			t.Errorf("%+v: expected collision error, got: %v", c, err)
+		}
+	}
+}
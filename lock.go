@@ -0,0 +1,156 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// how often a run checks if the window lock held by another run was released when V3_WINDOW_LOCK_WAIT is set
+const gWindowLockPollInterval = time.Second
+
+// AdvisoryLockID - returns Postgres advisory lock ID for a lock name
+func AdvisoryLockID(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// AdvisoryLock - Postgres session level advisory locks held on a dedicated connection, they are released by Postgres
+// when the connection is closed, so they are never left behind when the holder fails or crashes
+type AdvisoryLock struct {
+	conn  *sql.Conn
+	mtx   sync.Mutex
+	held  []string      // names of locks held
+	lost  chan struct{} // closed when connection is lost, see KeepAlive
+	done  chan struct{} // closed by Release
+	debug bool
+}
+
+// NewAdvisoryLock - returns advisory lock using a dedicated connection from db pool
+func NewAdvisoryLock(ctx context.Context, db *sql.DB, debug bool) (*AdvisoryLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &AdvisoryLock{conn: conn, lost: make(chan struct{}), done: make(chan struct{}), debug: debug}, nil
+}
+
+// Acquire - takes lock name, polls every poll up to wait for it, returns false if it is still held by another session
+func (l *AdvisoryLock) Acquire(ctx context.Context, name string, wait, poll time.Duration) (bool, error) {
+	dtStart := time.Now()
+	for {
+		var locked bool
+		err := l.conn.QueryRowContext(ctx, "select pg_try_advisory_lock($1)", AdvisoryLockID(name)).Scan(&locked)
+		if err != nil {
+			return false, err
+		}
+		if locked {
+			if l.debug {
+				Logf("acquired lock '%s'\n", name)
+			}
+			l.mtx.Lock()
+			l.held = append(l.held, name)
+			l.mtx.Unlock()
+			return true, nil
+		}
+		remaining := wait - time.Now().Sub(dtStart)
+		if remaining <= 0 {
+			return false, nil
+		}
+		Logf("lock '%s' is held by another session, waiting up to %v\n", name, remaining)
+		if remaining > poll {
+			remaining = poll
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// Hold - takes lock name, waits for it as long as needed (or until ctx is done)
+func (l *AdvisoryLock) Hold(ctx context.Context, name string) error {
+	_, err := l.conn.ExecContext(ctx, "select pg_advisory_lock($1)", AdvisoryLockID(name))
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	l.held = append(l.held, name)
+	l.mtx.Unlock()
+	return nil
+}
+
+// KeepAlive - pings lock connection every interval until Release and returns channel closed when ping fails,
+// long lived locks are gone with their connection, so their holder must stop relying on them then
+func (l *AdvisoryLock) KeepAlive(interval time.Duration) <-chan struct{} {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := l.conn.PingContext(ctx)
+			cancel()
+			if err != nil {
+				select {
+				case <-l.done:
+					return
+				default:
+				}
+				Logf("error: lock connection lost, locks %v are released: %+v\n", l.names(), err)
+				close(l.lost)
+				return
+			}
+		}
+	}()
+	return l.lost
+}
+
+// names - returns names of locks held
+func (l *AdvisoryLock) names() []string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]string{}, l.held...)
+}
+
+// Release - releases all locks and returns the connection to the pool
+// connection is reused by the pool, so session level locks must be released explicitly
+func (l *AdvisoryLock) Release() {
+	close(l.done)
+	for _, name := range l.names() {
+		_, err := l.conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", AdvisoryLockID(name))
+		if err != nil {
+			Logf("error releasing lock '%s': %+v\n", name, err)
+		}
+	}
+	_ = l.conn.Close()
+}
+
+// windowLockName - lock name identifying calculated window: table, project slug, time range, date from and date to
+func windowLockName(table string, c *Calculation, dtf, dtt time.Time) string {
+	return fmt.Sprintf("calcmetric-window:%s:%s:%s:%s:%s", table, c.ProjectSlug, c.TimeRange, ToYMD(dtf), ToYMD(dtt))
+}
+
+// lockWindow - takes window lock, waits up to V3_WINDOW_LOCK_WAIT for it, returns nil lock if it is still held by another run
+// Slices staging table is also locked with it, so SweepSlices never drops a staging table of a running calculation
+func lockWindow(ctx context.Context, db *sql.DB, table string, c *Calculation, dtf, dtt time.Time) (*AdvisoryLock, error) {
+	lock, err := NewAdvisoryLock(ctx, db, c.Debug)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lock.Acquire(ctx, windowLockName(table, c, dtf, dtt), c.WindowLockWait, gWindowLockPollInterval)
+	if err != nil || !locked {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
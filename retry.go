@@ -0,0 +1,62 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/lib/pq"
+)
+
+// FatalExitCode - exit code used by calcmetric when calculation failed with an error that retrying cannot fix
+const FatalExitCode = 65
+
+// Postgres error classes and codes of transient errors, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+var (
+	gRetriableClasses = map[pq.ErrorClass]struct{}{
+		"08": {}, // connection exception
+		"40": {}, // transaction rollback: serialization failure, deadlock detected
+		"53": {}, // insufficient resources: too many connections, out of memory, disk full
+		"58": {}, // system error: I/O error
+		"XX": {}, // internal error
+	}
+	gRetriableCodes = map[pq.ErrorCode]struct{}{
+		"57P01": {}, // admin_shutdown
+		"57P02": {}, // crash_shutdown
+		"57P03": {}, // cannot_connect_now
+		"55P03": {}, // lock_not_available
+	}
+)
+
+// IsRetriable - returns true if calculation failed with a transient error, so it can succeed when retried:
+// connection errors, serialization failures and deadlocks, database restarts and timeouts (see IsTimeout)
+// All other errors are fatal: SQL syntax errors, undefined tables, columns or types, data errors, unknown result
+// column types, missing params and other invalid configuration, and calculations cancelled by the caller
+func IsRetriable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if IsTimeout(err) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		_, ok := gRetriableCodes[pqErr.Code]
+		if ok {
+			return true
+		}
+		_, ok = gRetriableClasses[pqErr.Code.Class()]
+		return ok
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,62 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsRetriable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "connection failure", err: &pq.Error{Code: "08006"}, expected: true},
+		{name: "connection exception", err: &pq.Error{Code: "08000"}, expected: true},
+		{name: "serialization failure", err: &pq.Error{Code: "40001"}, expected: true},
+		{name: "deadlock", err: &pq.Error{Code: "40P01"}, expected: true},
+		{name: "too many connections", err: &pq.Error{Code: "53300"}, expected: true},
+		{name: "disk full", err: &pq.Error{Code: "53100"}, expected: true},
+		{name: "io error", err: &pq.Error{Code: "58030"}, expected: true},
+		{name: "internal error", err: &pq.Error{Code: "XX000"}, expected: true},
+		{name: "admin shutdown", err: &pq.Error{Code: "57P01"}, expected: true},
+		{name: "crash shutdown", err: &pq.Error{Code: "57P02"}, expected: true},
+		{name: "cannot connect now", err: &pq.Error{Code: "57P03"}, expected: true},
+		{name: "lock not available", err: &pq.Error{Code: "55P03"}, expected: true},
+		{name: "wrapped deadlock", err: fmt.Errorf("calculation failed: %w", &pq.Error{Code: "40P01"}), expected: true},
+		{name: "statement timeout", err: &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, expected: true},
+		{name: "user cancel", err: &pq.Error{Code: "57014", Message: "canceling statement due to user request"}, expected: false},
+		{name: "syntax error", err: &pq.Error{Code: "42601"}, expected: false},
+		{name: "undefined table", err: &pq.Error{Code: "42P01"}, expected: false},
+		{name: "undefined column", err: &pq.Error{Code: "42703"}, expected: false},
+		{name: "division by zero", err: &pq.Error{Code: "22012"}, expected: false},
+		{name: "other object state", err: &pq.Error{Code: "55000"}, expected: false},
+		{name: "bad connection", err: driver.ErrBadConn, expected: true},
+		{name: "eof", err: io.EOF, expected: true},
+		{name: "unexpected eof", err: fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), expected: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, expected: true},
+		{name: "connection reset", err: fmt.Errorf("query: %w", syscall.ECONNRESET), expected: true},
+		{name: "broken pipe", err: syscall.EPIPE, expected: true},
+		{name: "dns error", err: &net.DNSError{Err: "no such host", Name: "db"}, expected: true},
+		{name: "deadline", err: context.DeadlineExceeded, expected: true},
+		{name: "timeout", err: fmt.Errorf("%w: deadline exceeded", ErrTimeout), expected: true},
+		{name: "cancelled", err: context.Canceled, expected: false},
+		{name: "wrapped cancelled", err: fmt.Errorf("sync is stopping: %w", context.Canceled), expected: false},
+		{name: "configuration", err: errors.New("missing params: {{tenant_id}}"), expected: false},
+	}
+	for _, tc := range testCases {
+		got := IsRetriable(tc.err)
+		if got != tc.expected {
+			t.Errorf("%s: expected %v, got %v for: %v", tc.name, tc.expected, got, tc.err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema policies, used when metric SQL columns differ from columns of already existing result table
+const (
+	SchemaRefuse = "refuse" // refuse to calculate and report what changed (default)
+	SchemaAdd    = "add"    // add new columns, refuse on type changes
+	SchemaWiden  = "widen"  // add new columns and widen types of existing columns when compatible
+)
+
+var (
+	// DDL type names mapped to their information_schema.columns.data_type names
+	gCanonicalTypes = map[string]string{
+		"bool":        "boolean",
+		"int2":        "smallint",
+		"int":         "integer",
+		"int4":        "integer",
+		"int8":        "bigint",
+		"float4":      "real",
+		"float8":      "double precision",
+		"varchar":     "character varying",
+		"timestamp":   "timestamp without time zone",
+		"timestamptz": "timestamp with time zone",
+		"time":        "time without time zone",
+		"timetz":      "time with time zone",
+	}
+	// Types that a given type can be altered to without losing data
+	gWiderTypes = map[string][]string{
+		"smallint":                    {"integer", "bigint", "numeric"},
+		"integer":                     {"bigint", "numeric"},
+		"bigint":                      {"numeric"},
+		"real":                        {"double precision", "numeric"},
+		"double precision":            {"numeric"},
+		"character varying":           {"text"},
+		"date":                        {"timestamp without time zone", "timestamp with time zone"},
+		"timestamp without time zone": {"timestamp with time zone"},
+	}
+)
+
+// tableColumn - column of an existing result table as reported by information_schema
+type tableColumn struct {
+	dataType string
+	nullable bool
+}
+
+// schemaDiff - differences between metric SQL columns and existing result table columns
+type schemaDiff struct {
+	added        []string // new columns, as "name type"
+	widened      []string // compatible type changes, as "name: old -> new"
+	incompatible []string // incompatible type changes, as "name: old -> new"
+	removed      []string // columns no longer returned by metric SQL that are "not null"
+	alters       []string // DDL needed to apply added and widened changes
+}
+
+func (d *schemaDiff) String() string {
+	parts := []string{}
+	for _, item := range []struct {
+		name string
+		ary  []string
+	}{
+		{"added", d.added},
+		{"widened", d.widened},
+		{"incompatible", d.incompatible},
+		{"removed not null", d.removed},
+	} {
+		if len(item.ary) > 0 {
+			parts = append(parts, item.name+": "+strings.Join(item.ary, ", "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// canonicalType - returns information_schema name for a DDL type name
+func canonicalType(tp string) string {
+	tp = strings.ToLower(strings.TrimSpace(tp))
+	if strings.HasSuffix(tp, "[]") {
+		return "ARRAY"
+	}
+	if i := strings.Index(tp, "("); i > 0 {
+		tp = strings.TrimSpace(tp[:i])
+	}
+	canonical, ok := gCanonicalTypes[tp]
+	if ok {
+		return canonical
+	}
+	return tp
+}
+
+// canWiden - returns true if column of type to can hold all values of type from without losing data
+func canWiden(from, to string) bool {
+	for _, wider := range gWiderTypes[from] {
+		if wider == to {
+			return true
+		}
+	}
+	return false
+}
+
+// tableColumns - returns existing table columns, empty map means that table doesn't exist yet
+func tableColumns(ctx context.Context, db *sql.DB, table string, debug bool) (map[string]tableColumn, error) {
+	sqlQuery := `select column_name, data_type, is_nullable from information_schema.columns where table_schema = current_schema() and table_name = $1`
+	args := []interface{}{table}
+	if debug {
+		Logf("executing sql: %s\nwith args: %+v\n", sqlQuery, args)
+	}
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		QueryOut(sqlQuery, args...)
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	columns := make(map[string]tableColumn)
+	var name, dataType, nullable string
+	for rows.Next() {
+		err := rows.Scan(&name, &dataType, &nullable)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = tableColumn{dataType: dataType, nullable: nullable == "YES"}
+	}
+	return columns, rows.Err()
+}
+
+// diffSchema - compares metric SQL columns with existing table columns
+func diffSchema(table string, existing map[string]tableColumn, colNames, colTypes []string) *schemaDiff {
+	d := &schemaDiff{}
+	wanted := make(map[string]struct{})
+	for _, key := range fixedColumns() {
+		wanted[key] = struct{}{}
+	}
+	for i, colName := range colNames {
+		name := strings.ToLower(colName)
+		wanted[name] = struct{}{}
+		col, ok := existing[name]
+		if !ok {
+			d.added = append(d.added, colName+" "+colTypes[i])
+			d.alters = append(d.alters, fmt.Sprintf(`alter table "%s" add column %s %s`, table, colName, colTypes[i]))
+			continue
+		}
+		tp := canonicalType(colTypes[i])
+		if tp == col.dataType || canWiden(tp, col.dataType) {
+			continue
+		}
+		change := fmt.Sprintf("%s: %s -> %s", colName, col.dataType, colTypes[i])
+		if canWiden(col.dataType, tp) {
+			d.widened = append(d.widened, change)
+			d.alters = append(d.alters, fmt.Sprintf(`alter table "%s" alter column %s type %s using %s::%s`, table, colName, colTypes[i], colName, colTypes[i]))
+			continue
+		}
+		d.incompatible = append(d.incompatible, change)
+	}
+	for name, col := range existing {
+		_, ok := wanted[name]
+		if !ok && !col.nullable {
+			d.removed = append(d.removed, name)
+		}
+	}
+	sort.Strings(d.removed)
+	return d
+}
+
+// evolveSchema - makes existing result table match metric SQL columns according to schema policy
+func evolveSchema(ctx context.Context, db *sql.DB, table string, colNames, colTypes []string, c *Calculation) error {
+	existing, err := tableColumns(ctx, db, table, c.Debug)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	d := diffSchema(table, existing, colNames, colTypes)
+	diff := d.String()
+	if diff == "" {
+		return nil
+	}
+	policy := c.SchemaPolicy
+	if policy == "" {
+		policy = SchemaRefuse
+	}
+	switch policy {
+	case SchemaRefuse:
+		return fmt.Errorf("table '%s' schema differs from metric '%s' columns (%s), refusing due to %s schema policy", table, c.Metric, diff, policy)
+	case SchemaAdd:
+		if len(d.widened) > 0 || len(d.incompatible) > 0 || len(d.removed) > 0 {
+			return fmt.Errorf("table '%s' schema differs from metric '%s' columns (%s), %s schema policy only allows adding columns", table, c.Metric, diff, policy)
+		}
+	case SchemaWiden:
+		if len(d.incompatible) > 0 || len(d.removed) > 0 {
+			return fmt.Errorf("table '%s' schema differs from metric '%s' columns (%s), %s schema policy only allows adding columns and widening types", table, c.Metric, diff, policy)
+		}
+	default:
+		return fmt.Errorf("unknown schema policy: '%s', allowed: %s, %s, %s", policy, SchemaRefuse, SchemaAdd, SchemaWiden)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, alter := range d.alters {
+		if c.Debug {
+			Logf("alter table:\n%s\n", alter)
+		}
+		_, err = tx.ExecContext(ctx, alter)
+		if err != nil {
+			QueryOut(alter, []interface{}{}...)
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	Logf("table '%s' schema evolved using %s schema policy: %s\n", table, policy, diff)
+	return nil
+}
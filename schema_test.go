@@ -0,0 +1,124 @@
+package calcmetric
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanWiden(t *testing.T) {
+	testCases := []struct {
+		from, to string
+		expected bool
+	}{
+		{"integer", "bigint", true},
+		{"smallint", "numeric", true},
+		{"real", "double precision", true},
+		{"character varying", "text", true},
+		{"date", "timestamp with time zone", true},
+		{"bigint", "integer", false},
+		{"text", "character varying", false},
+		{"timestamp with time zone", "date", false},
+		{"integer", "integer", false},
+		{"integer", "text", false},
+		{"text", "integer", false},
+	}
+	for _, tc := range testCases {
+		got := canWiden(tc.from, tc.to)
+		if got != tc.expected {
+			t.Errorf("canWiden(%s, %s): expected %v, got %v", tc.from, tc.to, tc.expected, got)
+		}
+	}
+}
+
+func TestDiffSchema(t *testing.T) {
+	existing := func(extra map[string]tableColumn) map[string]tableColumn {
+		columns := make(map[string]tableColumn)
+		for _, name := range fixedColumns() {
+			columns[name] = tableColumn{dataType: "text"}
+		}
+		for name, col := range extra {
+			columns[name] = col
+		}
+		return columns
+	}
+	testCases := []struct {
+		name     string
+		existing map[string]tableColumn
+		colNames []string
+		colTypes []string
+		expected schemaDiff
+		diff     string
+	}{
+		{
+			name:     "equal",
+			existing: existing(map[string]tableColumn{"cnt": {dataType: "bigint"}, "name": {dataType: "text", nullable: true}}),
+			colNames: []string{"cnt", "Name"},
+			colTypes: []string{"int8", "text"},
+		},
+		{
+			name:     "narrowing fits existing",
+			existing: existing(map[string]tableColumn{"cnt": {dataType: "bigint"}, "name": {dataType: "text"}}),
+			colNames: []string{"cnt", "name"},
+			colTypes: []string{"int", "varchar(255)"},
+		},
+		{
+			name:     "added",
+			existing: existing(map[string]tableColumn{"cnt": {dataType: "bigint"}}),
+			colNames: []string{"cnt", "new_col"},
+			colTypes: []string{"bigint", "double precision"},
+			expected: schemaDiff{
+				added:  []string{"new_col double precision"},
+				alters: []string{`alter table "t" add column new_col double precision`},
+			},
+			diff: "added: new_col double precision",
+		},
+		{
+			name:     "widening",
+			existing: existing(map[string]tableColumn{"cnt": {dataType: "integer"}, "name": {dataType: "character varying"}}),
+			colNames: []string{"cnt", "name"},
+			colTypes: []string{"bigint", "text"},
+			expected: schemaDiff{
+				widened: []string{"cnt: integer -> bigint", "name: character varying -> text"},
+				alters: []string{
+					`alter table "t" alter column cnt type bigint using cnt::bigint`,
+					`alter table "t" alter column name type text using name::text`,
+				},
+			},
+			diff: "widened: cnt: integer -> bigint, name: character varying -> text",
+		},
+		{
+			name:     "incompatible",
+			existing: existing(map[string]tableColumn{"cnt": {dataType: "bigint"}}),
+			colNames: []string{"cnt"},
+			colTypes: []string{"text"},
+			expected: schemaDiff{
+				incompatible: []string{"cnt: bigint -> text"},
+			},
+			diff: "incompatible: cnt: bigint -> text",
+		},
+		{
+			name: "removed",
+			existing: existing(map[string]tableColumn{
+				"cnt":      {dataType: "bigint"},
+				"old_b":    {dataType: "bigint"},
+				"old_a":    {dataType: "text"},
+				"optional": {dataType: "text", nullable: true},
+			}),
+			colNames: []string{"cnt"},
+			colTypes: []string{"bigint"},
+			expected: schemaDiff{
+				removed: []string{"old_a", "old_b"},
+			},
+			diff: "removed not null: old_a, old_b",
+		},
+	}
+	for _, tc := range testCases {
+		got := diffSchema("t", tc.existing, tc.colNames, tc.colTypes)
+		if !reflect.DeepEqual(*got, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, *got)
+		}
+		if got.String() != tc.diff {
+			t.Errorf("%s: expected diff '%s', got '%s'", tc.name, tc.diff, got.String())
+		}
+	}
+}
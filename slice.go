@@ -0,0 +1,280 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Slice granularities (V3_SLICE), additive metrics (declaring reduce SQL in front-matter) can be calculated
+// as time range slices computed concurrently and combined by the reduce SQL
+const (
+	SliceDay     = "day"
+	SliceWeek    = "week"
+	SliceMonth   = "month"
+	SliceQuarter = "quarter"
+	SliceYear    = "year"
+)
+
+var gSliceUnits = map[string]byte{
+	SliceDay:     'd',
+	SliceWeek:    'w',
+	SliceMonth:   'm',
+	SliceQuarter: 'q',
+	SliceYear:    'y',
+}
+
+// gSliceTablePrefix - prefix of slices staging tables names
+const gSliceTablePrefix = "slc_"
+
+// sliceTable - returns name of a staging table for slices of a single calculation
+func sliceTable() string {
+	return fmt.Sprintf("%s%d_%x", gSliceTablePrefix, os.Getpid(), time.Now().UnixNano())
+}
+
+// sliceRanges - splits dtf - dtt into slices aligned to calendar units, first and last slices can be shorter
+func sliceRanges(dtf, dtt time.Time, slice string, cal calendar) ([][2]time.Time, error) {
+	unit, ok := gSliceUnits[slice]
+	if !ok {
+		return nil, fmt.Errorf("unknown slice: '%s', allowed: %s, %s, %s, %s, %s", slice, SliceDay, SliceWeek, SliceMonth, SliceQuarter, SliceYear)
+	}
+	ranges := [][2]time.Time{}
+	for from := dtf; from.Before(dtt); {
+		to := addUnits(unitStart(from, 1, unit, cal), 1, unit)
+		if to.After(dtt) {
+			to = dtt
+		}
+		ranges = append(ranges, [2]time.Time{from, to})
+		from = to
+	}
+	return ranges, nil
+}
+
+// renderSlice - returns metric SQL for a single slice
+func renderSlice(tmpl string, values map[string]string, from, to time.Time, c *Calculation) (string, error) {
+	sliceValues := make(map[string]string)
+	for k, v := range values {
+		sliceValues[k] = v
+	}
+	sliceValues["date_from"] = ToYMDQuoted(from)
+	sliceValues["date_to"] = ToYMDQuoted(to)
+	sql, err := renderTemplate(tmpl, sliceValues)
+	if err != nil {
+		return "", err
+	}
+	left := unresolvedPlaceholders(sql)
+	if len(left) > 0 {
+		return "", fmt.Errorf("metric '%s' generated SQL still contains placeholders: %s", c.Metric, strings.Join(left, ", "))
+	}
+	return sql, nil
+}
+
+// execSlice - executes DDL/DML for a slice, with session time zone and statement timeout set just like for the metric SQL
+func execSlice(ctx context.Context, db *sql.DB, query string, c *Calculation, res *Result) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	err = setSession(ctx, tx, c, res, true)
+	if err != nil {
+		return 0, err
+	}
+	rslt, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		QueryOut(query, []interface{}{}...)
+		return 0, err
+	}
+	rows, err := rslt.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return rows, tx.Commit()
+}
+
+// calculateSlices - calculates metric SQL for all slices of dtf - dtt concurrently into staging table
+// and returns reduce SQL that combines them, caller must drop the staging table
+func calculateSlices(ctx context.Context, db *sql.DB, tmpl, reduce, staging string, values map[string]string, dtf, dtt time.Time, c *Calculation, res *Result) (string, error) {
+	cal, err := c.calendar()
+	if err != nil {
+		return "", err
+	}
+	ranges, err := sliceRanges(dtf, dtt, c.Slice, cal)
+	if err != nil {
+		return "", err
+	}
+	if len(ranges) == 0 {
+		return "", fmt.Errorf("time range %s - %s has no %s slices", ToYMDQuoted(dtf), ToYMDQuoted(dtt), c.Slice)
+	}
+	queries := []string{}
+	for _, rng := range ranges {
+		sql, err := renderSlice(tmpl, values, rng[0], rng[1], c)
+		if err != nil {
+			return "", err
+		}
+		queries = append(queries, sql)
+	}
+	// Staging table has metric SQL's columns, "with no data" only plans the query
+	createStaging := fmt.Sprintf(`create unlogged table "%s" as %s with no data`, staging, queries[0])
+	if c.Debug {
+		Logf("create slices table:\n%s\n", createStaging)
+	}
+	_, err = execSlice(ctx, db, createStaging, c, res)
+	if err != nil {
+		return "", err
+	}
+	threads := c.SliceThreads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	Logf("calculating %d %s slices using %d threads\n", len(ranges), c.Slice, threads)
+	sliceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type sliceResult struct {
+		idx  int
+		rows int64
+		took time.Duration
+		err  error
+	}
+	ch := make(chan sliceResult)
+	sem := make(chan struct{}, threads)
+	dtSlices := time.Now()
+	go func() {
+		for i, query := range queries {
+			sem <- struct{}{}
+			go func(i int, query string) {
+				defer func() { <-sem }()
+				dtStart := time.Now()
+				insert := fmt.Sprintf(`insert into "%s" %s`, staging, query)
+				if c.Debug {
+					Logf("slice #%d:\n%s\n", i, insert)
+				}
+				rows, err := execSlice(sliceCtx, db, insert, c, res)
+				ch <- sliceResult{idx: i, rows: rows, took: time.Now().Sub(dtStart), err: err}
+			}(i, query)
+		}
+	}()
+	var (
+		firstErr error
+		nRows    int64
+	)
+	for range queries {
+		r := <-ch
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("slice %s - %s: %w", ToYMDQuoted(ranges[r.idx][0]), ToYMDQuoted(ranges[r.idx][1]), r.err)
+				cancel()
+			}
+			continue
+		}
+		nRows += r.rows
+		if c.Debug {
+			Logf("slice %s - %s: %d rows in %v\n", ToYMDQuoted(ranges[r.idx][0]), ToYMDQuoted(ranges[r.idx][1]), r.rows, r.took)
+		}
+	}
+	if firstErr != nil {
+		return "", firstErr
+	}
+	Logf("calculated %d slices with %d rows in %v\n", len(ranges), nRows, time.Now().Sub(dtSlices))
+	return renderReduce(reduce, values, dtf, dtt, c)
+}
+
+// renderReduce - returns reduce SQL combining slices of dtf - dtt (from {{slices}} table)
+func renderReduce(reduce string, values map[string]string, dtf, dtt time.Time, c *Calculation) (string, error) {
+	reduceValues := make(map[string]string)
+	for k, v := range values {
+		reduceValues[k] = v
+	}
+	reduceValues["date_from"] = ToYMDQuoted(dtf)
+	reduceValues["date_to"] = ToYMDQuoted(dtt)
+	sql, err := renderTemplate(reduce, reduceValues)
+	if err != nil {
+		return "", err
+	}
+	left := unresolvedPlaceholders(sql)
+	if len(left) > 0 {
+		return "", fmt.Errorf("metric '%s' generated reduce SQL still contains placeholders: %s", c.Metric, strings.Join(left, ", "))
+	}
+	return sql, nil
+}
+
+// dropSlices - drops slices staging table
+func dropSlices(ctx context.Context, db *sql.DB, staging string, debug bool) {
+	dropTable := fmt.Sprintf(`drop table if exists "%s"`, staging)
+	if debug {
+		Logf("drop slices table:\n%s\n", dropTable)
+	}
+	_, err := db.ExecContext(ctx, dropTable)
+	if err != nil {
+		Logf("error dropping slices table '%s': %+v\n", staging, err)
+		QueryOut(dropTable, []interface{}{}...)
+	}
+}
+
+// SweepSlices - drops slices staging tables left behind by crashed calculations and returns their number
+// Calculation holds an advisory lock named after its staging table while the table exists (Postgres releases it when
+// calculation's connection is closed), so staging table whose lock can be acquired has no running calculation
+func SweepSlices(ctx context.Context, db *sql.DB, debug bool) (int, error) {
+	sqlQuery := `select tablename from pg_tables where schemaname = current_schema() and tablename like $1`
+	args := []interface{}{strings.Replace(gSliceTablePrefix, "_", `\_`, -1) + "%"}
+	if debug {
+		Logf("executing sql: %s\nwith args: %+v\n", sqlQuery, args)
+	}
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		QueryOut(sqlQuery, args...)
+		return 0, err
+	}
+	tables := []string{}
+	var table string
+	for rows.Next() {
+		err = rows.Scan(&table)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		tables = append(tables, table)
+	}
+	_ = rows.Close()
+	err = rows.Err()
+	if err != nil || len(tables) == 0 {
+		return 0, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	dropped := 0
+	for _, table := range tables {
+		var locked bool
+		id := AdvisoryLockID(table)
+		err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock($1)", id).Scan(&locked)
+		if err != nil {
+			return dropped, err
+		}
+		if !locked {
+			if debug {
+				Logf("slices table '%s' is used by a running calculation\n", table)
+			}
+			continue
+		}
+		dropTable := fmt.Sprintf(`drop table if exists "%s"`, table)
+		_, err = conn.ExecContext(ctx, dropTable)
+		_, unlockErr := conn.ExecContext(ctx, "select pg_advisory_unlock($1)", id)
+		if err != nil {
+			QueryOut(dropTable, []interface{}{}...)
+			return dropped, err
+		}
+		if unlockErr != nil {
+			return dropped, unlockErr
+		}
+		Logf("dropped slices table '%s' left behind by a crashed calculation\n", table)
+		dropped++
+	}
+	return dropped, nil
+}
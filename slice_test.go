@@ -0,0 +1,134 @@
+package calcmetric
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSliceRanges(t *testing.T) {
+	ymd := func(s string) time.Time {
+		dt, err := TimeParseAny(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dt
+	}
+	calendarYear := calendar{weekStart: time.Monday, yearStart: time.January}
+	testCases := []struct {
+		name     string
+		from, to string
+		slice    string
+		cal      calendar
+		expected []string
+		err      string
+	}{
+		{
+			name: "aligned months", from: "2026-01-01", to: "2026-04-01", slice: SliceMonth, cal: calendarYear,
+			expected: []string{"2026-01-01 - 2026-02-01", "2026-02-01 - 2026-03-01", "2026-03-01 - 2026-04-01"},
+		},
+		{
+			name: "partial first and last month", from: "2026-01-15", to: "2026-03-10", slice: SliceMonth, cal: calendarYear,
+			expected: []string{"2026-01-15 - 2026-02-01", "2026-02-01 - 2026-03-01", "2026-03-01 - 2026-03-10"},
+		},
+		{
+			name: "weeks from monday", from: "2026-08-05", to: "2026-08-19", slice: SliceWeek, cal: calendarYear,
+			expected: []string{"2026-08-05 - 2026-08-10", "2026-08-10 - 2026-08-17", "2026-08-17 - 2026-08-19"},
+		},
+		{
+			name: "weeks from sunday", from: "2026-08-05", to: "2026-08-19", slice: SliceWeek, cal: calendar{weekStart: time.Sunday, yearStart: time.January},
+			expected: []string{"2026-08-05 - 2026-08-09", "2026-08-09 - 2026-08-16", "2026-08-16 - 2026-08-19"},
+		},
+		{
+			name: "calendar quarters", from: "2025-11-20", to: "2026-05-01", slice: SliceQuarter, cal: calendarYear,
+			expected: []string{"2025-11-20 - 2026-01-01", "2026-01-01 - 2026-04-01", "2026-04-01 - 2026-05-01"},
+		},
+		{
+			name: "fiscal quarters", from: "2025-07-01", to: "2026-07-01", slice: SliceQuarter, cal: calendar{weekStart: time.Monday, yearStart: time.February},
+			expected: []string{"2025-07-01 - 2025-08-01", "2025-08-01 - 2025-11-01", "2025-11-01 - 2026-02-01", "2026-02-01 - 2026-05-01", "2026-05-01 - 2026-07-01"},
+		},
+		{
+			name: "fiscal years", from: "2024-01-01", to: "2026-01-01", slice: SliceYear, cal: calendar{weekStart: time.Monday, yearStart: time.July},
+			expected: []string{"2024-01-01 - 2024-07-01", "2024-07-01 - 2025-07-01", "2025-07-01 - 2026-01-01"},
+		},
+		{
+			name: "days", from: "2026-02-27", to: "2026-03-02", slice: SliceDay, cal: calendarYear,
+			expected: []string{"2026-02-27 - 2026-02-28", "2026-02-28 - 2026-03-01", "2026-03-01 - 2026-03-02"},
+		},
+		{
+			name: "shorter than one slice", from: "2026-03-03", to: "2026-03-20", slice: SliceMonth, cal: calendarYear,
+			expected: []string{"2026-03-03 - 2026-03-20"},
+		},
+		{
+			name: "shorter than one year", from: "2026-02-01", to: "2026-03-01", slice: SliceYear, cal: calendarYear,
+			expected: []string{"2026-02-01 - 2026-03-01"},
+		},
+		{name: "empty", from: "2026-03-01", to: "2026-03-01", slice: SliceDay, cal: calendarYear, expected: []string{}},
+		{name: "unknown slice", from: "2026-01-01", to: "2026-02-01", slice: "hour", cal: calendarYear, err: "unknown slice: 'hour'"},
+	}
+	for _, tc := range testCases {
+		ranges, err := sliceRanges(ymd(tc.from), ymd(tc.to), tc.slice, tc.cal)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing '%s', got: %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		got := []string{}
+		for _, rng := range ranges {
+			got = append(got, ToYMD(rng[0])+" - "+ToYMD(rng[1]))
+		}
+		if strings.Join(got, ", ") != strings.Join(tc.expected, ", ") {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestRenderSlice(t *testing.T) {
+	c := &Calculation{Metric: "contributors"}
+	values := map[string]string{"project_slug": "k8s", "date_from": "2026-01-01", "date_to": "2026-04-01"}
+	from := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	sql, err := renderSlice("select count(*) from a where slug = {{project_slug}} and ts >= {{date_from}} and ts < {{date_to}}", values, from, to, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "select count(*) from a where slug = 'k8s' and ts >= '2026-02-01' and ts < '2026-03-01'"
+	if sql != expected {
+		t.Errorf("expected '%s', got '%s'", expected, sql)
+	}
+	if values["date_from"] != "2026-01-01" || values["date_to"] != "2026-04-01" {
+		t.Errorf("values should not be modified, got %v", values)
+	}
+	_, err = renderSlice("select {{missing}}", values, from, to, c)
+	if err == nil || !strings.Contains(err.Error(), "metric 'contributors' generated SQL still contains placeholders: {{missing}}") {
+		t.Errorf("expected unresolved placeholders error, got: %v", err)
+	}
+	_, err = renderSlice("select '%{{project_slug}}%'", values, from, to, c)
+	if err == nil || !strings.Contains(err.Error(), "embedded in a longer string literal") {
+		t.Errorf("expected embedded placeholder error, got: %v", err)
+	}
+}
+
+func TestRenderReduce(t *testing.T) {
+	c := &Calculation{Metric: "contributors"}
+	values := map[string]string{"project_slug": "k8s", "slices": "slc_1_ab"}
+	dtf := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	dtt := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	sql, err := renderReduce("select memberid, sum(cnt) as cnt, {{date_from}} as df, {{date_to}} as dt from {{slices}} where slug = '{{project_slug}}' group by memberid", values, dtf, dtt, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `select memberid, sum(cnt) as cnt, '2026-01-15' as df, '2026-03-10' as dt from "slc_1_ab" where slug = 'k8s' group by memberid`
+	if sql != expected {
+		t.Errorf("expected '%s', got '%s'", expected, sql)
+	}
+	_, err = renderReduce("select * from {{slices}} limit {{limit}}", values, dtf, dtt, c)
+	if err == nil || !strings.Contains(err.Error(), "generated reduce SQL still contains placeholders: {{limit}}") {
+		t.Errorf("expected unresolved placeholders error, got: %v", err)
+	}
+}
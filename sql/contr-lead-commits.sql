@@ -1,3 +1,10 @@
+-- ---
+-- description: contributors leaderboard by number of commits
+-- limit: 200
+-- params:
+--   tenant_id: {required: true, description: tenant UUID}
+--   is_bot: {default: '!= true', description: condition on member's is_bot flag}
+-- ---
 with tot as (
   select
     count(distinct case when a.type = 'authored-commit' then a.sourceId when a.type in ('committed-commit', 'co-authored-commit') then a.sourceParentId end) as contributions,
@@ -19,7 +26,7 @@ with tot as (
     and a.deletedAt is null
     and a.timestamp >= {{date_from}}
     and a.timestamp < {{date_to}}
-    and m.is_bot {{is_bot}}
+    and m.is_bot {{is_bot:raw}}
     and p.project_slug = '{{project_slug}}'
 ), curr as (
   select
@@ -46,7 +53,7 @@ with tot as (
     and a.deletedAt is null
     and a.timestamp >= {{date_from}}
     and a.timestamp < {{date_to}}
-    and m.is_bot {{is_bot}}
+    and m.is_bot {{is_bot:raw}}
     and p.project_slug = '{{project_slug}}'
   group by
     m.logo_url,
@@ -79,7 +86,7 @@ with tot as (
     and a.deletedAt is null
     and a.timestamp >= {{date_from}}::timestamp - ({{date_to}}::timestamp - {{date_from}}::timestamp)
     and a.timestamp < {{date_to}}::timestamp - ({{date_to}}::timestamp - {{date_from}}::timestamp)
-    and m.is_bot {{is_bot}}
+    and m.is_bot {{is_bot:raw}}
     and p.project_slug = '{{project_slug}}'
     and (a.memberId, a.platform, a.username) in (select memberId, platform, username from curr)
   group by
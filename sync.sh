@@ -13,6 +13,7 @@ export V3_HEARTBEAT=300
 export V3_RETRY=2
 # export V3_DRY_RUN=y
 # export V3_YAML_PATH='./'
+# export V3_SUBPROCESS=y
 # export V3_BIN_PATH='./'
 # export V3_DEBUG=1
 export V3_THREADS=8
@@ -0,0 +1,347 @@
+package calcmetric
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Placeholder kinds, used as {{name:kind}} in metric SQL files
+const (
+	KindIdent  = "ident"  // SQL identifier, rendered double-quoted
+	KindString = "string" // literal string, rendered single-quoted and escaped
+	KindNumber = "number" // number, validated and rendered as is
+	KindDate   = "date"   // date, parsed and rendered as 'YYYY-MM-DD'
+	KindRaw    = "raw"    // raw SQL fragment, rendered as is - must be explicitly requested
+)
+
+var (
+	// {{name}} or {{name:kind}}
+	gPlaceholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*(?::\s*([a-z]+)\s*)?\}\}`)
+	// Anything that still looks like a placeholder after rendering
+	gUnresolvedRe = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	// Dollar quote opening tag: $$ or $tag$
+	gDollarTagRe = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+	// Kinds of built-in placeholders, all other placeholders default to KindString
+	gBuiltinKinds = map[string]string{
+		"project_slug": KindString,
+		"date_from":    KindDate,
+		"date_to":      KindDate,
+		"limit":        KindNumber,
+		"offset":       KindNumber,
+		"slices":       KindIdent,
+	}
+)
+
+// unquoteLiteral - if value is already a quoted SQL literal like 'abc' returns its contents
+// this is to support values that were quoted by the caller, when we were doing a plain text replace
+func unquoteLiteral(value string) string {
+	l := len(value)
+	if l < 2 || value[0] != '\'' || value[l-1] != '\'' {
+		return value
+	}
+	inner := value[1 : l-1]
+	if strings.Contains(strings.Replace(inner, "''", "", -1), "'") {
+		return value
+	}
+	return strings.Replace(inner, "''", "'", -1)
+}
+
+// renderPlaceholder - returns value formatted as SQL for a given placeholder kind
+func renderPlaceholder(name, kind, value string) (string, error) {
+	switch kind {
+	case KindIdent:
+		return pq.QuoteIdentifier(value), nil
+	case KindString:
+		return pq.QuoteLiteral(unquoteLiteral(value)), nil
+	case KindNumber:
+		_, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "", fmt.Errorf("placeholder {{%s}} expects a number, got: '%s'", name, value)
+		}
+		return strings.TrimSpace(value), nil
+	case KindDate:
+		dt, err := TimeParseAny(unquoteLiteral(value))
+		if err != nil {
+			return "", fmt.Errorf("placeholder {{%s}} expects a date, got: '%s'", name, value)
+		}
+		return ToYMDQuoted(dt), nil
+	case KindRaw:
+		return value, nil
+	default:
+		return "", fmt.Errorf("placeholder {{%s}} has unknown kind: '%s', allowed: %s, %s, %s, %s, %s", name, kind, KindIdent, KindString, KindNumber, KindDate, KindRaw)
+	}
+}
+
+// renderTemplate - replaces {{name}} and {{name:kind}} placeholders in tmpl with properly quoted values
+// Placeholders without kind use built-in kind for known names or KindString for all others
+// Placeholder that is the whole string literal like '{{project_slug}}' consumes the quotes, because rendered value is quoted already
+// Placeholders embedded in a longer string literal like '%{{q}}%' are refused (only KindRaw can be used there), because
+// their values cannot be safely quoted, use a separate literal instead, for example: '%' || {{q}} || '%'
+// Placeholders in comments are rendered as outside of string literals, placeholders in quoted identifiers are not rendered
+// Placeholders in E'...' escape strings and $$...$$ or $tag$...$tag$ dollar-quoted strings are refused, because their
+// values cannot be safely quoted there either
+// Placeholders without value are left untouched
+func renderTemplate(tmpl string, values map[string]string) (string, error) {
+	var (
+		b     strings.Builder
+		plain int // start of not yet rendered SQL outside of literals
+	)
+	flush := func(to int) error {
+		s, err := renderPlain(tmpl[plain:to], values)
+		b.WriteString(s)
+		return err
+	}
+	for i := 0; i < len(tmpl); {
+		var end int
+		switch {
+		case strings.HasPrefix(tmpl[i:], "--"):
+			end = strings.Index(tmpl[i:], "\n")
+			if end < 0 {
+				end = len(tmpl)
+			} else {
+				end += i
+			}
+			i = end
+			continue
+		case strings.HasPrefix(tmpl[i:], "/*"):
+			end = strings.Index(tmpl[i+2:], "*/")
+			if end < 0 {
+				end = len(tmpl)
+			} else {
+				end += i + 4
+			}
+			i = end
+			continue
+		case tmpl[i] == '\'' || tmpl[i] == '"':
+			end = quotedEnd(tmpl, i)
+		case (tmpl[i] == 'E' || tmpl[i] == 'e') && strings.HasPrefix(tmpl[i+1:], "'") && !identChar(tmpl, i-1):
+			end = escapedEnd(tmpl, i+1)
+		case tmpl[i] == '$' && !identChar(tmpl, i-1) && gDollarTagRe.MatchString(tmpl[i:]):
+			tag := gDollarTagRe.FindString(tmpl[i:])
+			end = strings.Index(tmpl[i+len(tag):], tag)
+			if end < 0 {
+				end = len(tmpl)
+			} else {
+				end += i + 2*len(tag)
+			}
+		default:
+			i++
+			continue
+		}
+		err := flush(i)
+		if err != nil {
+			return "", err
+		}
+		switch tmpl[i] {
+		case '"':
+			b.WriteString(tmpl[i:end])
+		case 'E', 'e', '$':
+			err := checkNoPlaceholders(tmpl[i:end], values)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(tmpl[i:end])
+		default:
+			s, err := renderLiteral(tmpl[i:end], values)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		}
+		i, plain = end, end
+	}
+	err := flush(len(tmpl))
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// quotedEnd - returns index just after quoted literal or identifier starting at tmpl[start], doubled quotes are escapes
+func quotedEnd(tmpl string, start int) int {
+	q := tmpl[start]
+	for i := start + 1; i < len(tmpl); i++ {
+		if tmpl[i] != q {
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == q {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(tmpl)
+}
+
+// escapedEnd - returns index just after E'...' escape string whose quote starts at tmpl[start], backslash escapes
+// the next character and doubled quotes are escapes too
+func escapedEnd(tmpl string, start int) int {
+	for i := start + 1; i < len(tmpl); i++ {
+		switch tmpl[i] {
+		case '\\':
+			i++
+		case '\'':
+			if i+1 < len(tmpl) && tmpl[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(tmpl)
+}
+
+// identChar - returns true if tmpl[i] can be a part of an SQL identifier (false when i is out of tmpl)
+func identChar(tmpl string, i int) bool {
+	if i < 0 || i >= len(tmpl) {
+		return false
+	}
+	c := tmpl[i]
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// checkNoPlaceholders - returns error if escape or dollar-quoted string contains a placeholder that has a value
+func checkNoPlaceholders(quoted string, values map[string]string) error {
+	for _, sub := range gPlaceholderRe.FindAllStringSubmatch(quoted, -1) {
+		_, ok := values[sub[1]]
+		if ok {
+			return fmt.Errorf("placeholder %s is used in an escape or dollar-quoted string %s, its value cannot be safely quoted there, use a separate literal instead", sub[0], quoted)
+		}
+	}
+	return nil
+}
+
+// placeholderKind - returns kind of a placeholder, built-in kind for known names or KindString when not specified
+func placeholderKind(name, kind string) string {
+	if kind != "" {
+		return kind
+	}
+	kind, ok := gBuiltinKinds[name]
+	if !ok {
+		kind = KindString
+	}
+	return kind
+}
+
+// renderPlain - renders placeholders outside of string literals
+func renderPlain(sql string, values map[string]string) (string, error) {
+	var err error
+	rendered := gPlaceholderRe.ReplaceAllStringFunc(sql, func(match string) string {
+		if err != nil {
+			return match
+		}
+		sub := gPlaceholderRe.FindStringSubmatch(match)
+		name := sub[1]
+		value, ok := values[name]
+		if !ok {
+			return match
+		}
+		s, e := renderPlaceholder(name, placeholderKind(name, sub[2]), value)
+		if e != nil {
+			err = e
+			return match
+		}
+		return s
+	})
+	return rendered, err
+}
+
+// renderLiteral - renders placeholders in a single-quoted string literal (with quotes)
+func renderLiteral(literal string, values map[string]string) (string, error) {
+	if len(literal) < 2 || literal[len(literal)-1] != '\'' {
+		return literal, nil
+	}
+	inner := literal[1 : len(literal)-1]
+	// Whole literal is a single placeholder
+	sub := gPlaceholderRe.FindStringSubmatch(inner)
+	if sub != nil && sub[0] == inner {
+		name := sub[1]
+		value, ok := values[name]
+		if !ok {
+			return literal, nil
+		}
+		kind := placeholderKind(name, sub[2])
+		s, err := renderPlaceholder(name, kind, value)
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case KindString, KindDate:
+			return s, nil
+		case KindNumber, KindRaw:
+			return "'" + s + "'", nil
+		default:
+			return "", fmt.Errorf("placeholder {{%s:%s}} cannot be used as a string literal", name, kind)
+		}
+	}
+	// Placeholders embedded in a longer literal
+	var err error
+	rendered := gPlaceholderRe.ReplaceAllStringFunc(inner, func(match string) string {
+		if err != nil {
+			return match
+		}
+		sub := gPlaceholderRe.FindStringSubmatch(match)
+		name := sub[1]
+		value, ok := values[name]
+		if !ok {
+			return match
+		}
+		kind := placeholderKind(name, sub[2])
+		if kind != KindRaw {
+			err = fmt.Errorf("placeholder %s is embedded in a longer string literal %s, its value cannot be safely quoted there, use a separate literal instead, for example: '%%' || {{%s}} || '%%'", match, literal, name)
+			return match
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return "'" + rendered + "'", nil
+}
+
+// templateUsage - returns sorted names of placeholders used by tmpl that have no value and names of values not used by tmpl
+func templateUsage(tmpl string, values map[string]string) ([]string, []string) {
+	used := make(map[string]struct{})
+	missing, unused := []string{}, []string{}
+	for _, sub := range gPlaceholderRe.FindAllStringSubmatch(tmpl, -1) {
+		name := sub[1]
+		_, ok := used[name]
+		if ok {
+			continue
+		}
+		used[name] = struct{}{}
+		_, ok = values[name]
+		if !ok {
+			missing = append(missing, "{{"+name+"}}")
+		}
+	}
+	for name := range values {
+		_, ok := used[name]
+		if !ok {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unused)
+	return missing, unused
+}
+
+// unresolvedPlaceholders - returns all distinct {{...}} tokens left in rendered SQL
+func unresolvedPlaceholders(sql string) []string {
+	left := []string{}
+	seen := make(map[string]struct{})
+	for _, token := range gUnresolvedRe.FindAllString(sql, -1) {
+		_, ok := seen[token]
+		if ok {
+			continue
+		}
+		seen[token] = struct{}{}
+		left = append(left, token)
+	}
+	return left
+}
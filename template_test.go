@@ -0,0 +1,104 @@
+package calcmetric
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	values := map[string]string{
+		"project_slug": "kubernetes",
+		"q":            "%' or true --",
+		"name":         "o'brien",
+		"quoted":       "'abc'",
+		"date_from":    "2026-01-02 10:11:12",
+		"limit":        " 10 ",
+		"slices":       "slc_1",
+		"is_bot":       "!= true",
+		"col":          `my "col"`,
+	}
+	testCases := []struct {
+		name     string
+		tmpl     string
+		expected string
+		err      string
+	}{
+		{name: "bare", tmpl: "where slug = {{project_slug}}", expected: "where slug = 'kubernetes'"},
+		{name: "bare injection", tmpl: "where q = {{q}}", expected: "where q = '%'' or true --'"},
+		{name: "bare escaped", tmpl: "where n = {{ name }}", expected: "where n = 'o''brien'"},
+		{name: "bare already quoted", tmpl: "where n = {{quoted}}", expected: "where n = 'abc'"},
+		{name: "quoted", tmpl: "where slug = '{{project_slug}}'", expected: "where slug = 'kubernetes'"},
+		{name: "quoted injection", tmpl: "where q = '{{q}}'", expected: "where q = '%'' or true --'"},
+		{name: "quoted escaped", tmpl: "where n = '{{name}}'", expected: "where n = 'o''brien'"},
+		{name: "quoted next to quoted", tmpl: "in ('{{name}}','{{project_slug}}')", expected: "in ('o''brien','kubernetes')"},
+		{name: "embedded like", tmpl: "where q like '%{{q}}%'", err: "embedded in a longer string literal"},
+		{name: "embedded prefix", tmpl: "where q like '{{q}}%'", err: "embedded in a longer string literal"},
+		{name: "embedded suffix", tmpl: "where q like '%{{name}}'", err: "embedded in a longer string literal"},
+		{name: "embedded two", tmpl: "where q = '{{name}}{{q}}'", err: "embedded in a longer string literal"},
+		{name: "embedded date", tmpl: "where d = '{{date_from}} 00:00'", err: "embedded in a longer string literal"},
+		{name: "concatenated", tmpl: "where q like '%' || {{q}} || '%'", expected: "where q like '%' || '%'' or true --' || '%'"},
+		{name: "literal with escaped quote", tmpl: "where a = 'it''s' and b = {{name}}", expected: "where a = 'it''s' and b = 'o''brien'"},
+		{name: "literal without placeholders", tmpl: "where a = '{{' and b = '}}'", expected: "where a = '{{' and b = '}}'"},
+		{name: "line comment", tmpl: "-- member's {{project_slug}}\nwhere n = '{{name}}'", expected: "-- member's 'kubernetes'\nwhere n = 'o''brien'"},
+		{name: "block comment", tmpl: "/* it's */ where n = {{name}}", expected: "/* it's */ where n = 'o''brien'"},
+		{name: "quoted identifier", tmpl: `select 1 as "{{name}}'s", {{name}}`, expected: `select 1 as "{{name}}'s", 'o''brien'`},
+		{name: "ident", tmpl: "select * from {{slices}}", expected: `select * from "slc_1"`},
+		{name: "ident kind", tmpl: "select {{col:ident}}", expected: `select "my ""col"""`},
+		{name: "ident quoted", tmpl: "select '{{slices}}'", err: "cannot be used as a string literal"},
+		{name: "ident embedded", tmpl: "select 'x{{slices}}'", err: "embedded in a longer string literal"},
+		{name: "number", tmpl: "limit {{limit}}", expected: "limit 10"},
+		{name: "number kind", tmpl: "limit {{limit:number}}", expected: "limit 10"},
+		{name: "number quoted", tmpl: "limit '{{limit}}'", expected: "limit '10'"},
+		{name: "number invalid", tmpl: "limit {{q:number}}", err: "expects a number"},
+		{name: "date", tmpl: "where t >= {{date_from}}", expected: "where t >= '2026-01-02'"},
+		{name: "date quoted", tmpl: "where t >= '{{date_from}}'", expected: "where t >= '2026-01-02'"},
+		{name: "date invalid", tmpl: "where t >= {{name:date}}", err: "expects a date"},
+		{name: "raw", tmpl: "where m.is_bot {{is_bot:raw}}", expected: "where m.is_bot != true"},
+		{name: "raw quoted", tmpl: "where m.is_bot = '{{is_bot:raw}}'", expected: "where m.is_bot = '!= true'"},
+		{name: "raw embedded", tmpl: "where m.is_bot = 'x {{is_bot:raw}} y'", expected: "where m.is_bot = 'x != true y'"},
+		{name: "unknown kind", tmpl: "{{name:text}}", err: "unknown kind"},
+		{name: "missing value", tmpl: "where a = {{missing}} and b = '{{missing}}' and c = 'x{{missing}}'", expected: "where a = {{missing}} and b = '{{missing}}' and c = 'x{{missing}}'"},
+		{name: "unterminated literal", tmpl: "where a = '{{name}}", expected: "where a = '{{name}}"},
+		{name: "escape string", tmpl: `where a = E'it\'s' and b = {{project_slug}}`, expected: `where a = E'it\'s' and b = 'kubernetes'`},
+		{name: "escape string lowercase", tmpl: `where a = e'\\' and b = '{{name}}'`, expected: `where a = e'\\' and b = 'o''brien'`},
+		{name: "escape string doubled quote", tmpl: `where a = E'it''s\n' and b = {{name}}`, expected: `where a = E'it''s\n' and b = 'o''brien'`},
+		{name: "escape string placeholder", tmpl: `where a = E'{{name}}'`, err: "escape or dollar-quoted string"},
+		{name: "identifier ending with e", tmpl: "select type, '{{name}}'", expected: "select type, 'o''brien'"},
+		{name: "dollar quoted", tmpl: "select $$it's$$, {{name}}", expected: "select $$it's$$, 'o''brien'"},
+		{name: "dollar quoted tag", tmpl: "select $body$ $$ it's $$ $body$, '{{name}}'", expected: "select $body$ $$ it's $$ $body$, 'o''brien'"},
+		{name: "dollar quoted placeholder", tmpl: "do $$ begin perform {{name}}; end $$", err: "escape or dollar-quoted string"},
+		{name: "dollar quoted tag placeholder", tmpl: "select $x$ '{{project_slug}}' $x$", err: "escape or dollar-quoted string"},
+		{name: "dollar quoted missing value", tmpl: "select $$ {{missing}} $$", expected: "select $$ {{missing}} $$"},
+		{name: "positional parameter", tmpl: "where a = $1 and b = {{name}}", expected: "where a = $1 and b = 'o''brien'"},
+	}
+	for _, tc := range testCases {
+		got, err := renderTemplate(tc.tmpl, values)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing '%s', got: '%s', %v", tc.name, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestTemplateUsage(t *testing.T) {
+	missing, unused := templateUsage("select {{a}}, '{{b:date}}', {{a}} from {{c:ident}}", map[string]string{"a": "1", "d": "2"})
+	if strings.Join(missing, ",") != "{{b}},{{c}}" {
+		t.Errorf("unexpected missing: %v", missing)
+	}
+	if strings.Join(unused, ",") != "d" {
+		t.Errorf("unexpected unused: %v", unused)
+	}
+	left := unresolvedPlaceholders("select {{a}}, {{ b }}, {{a}}")
+	if strings.Join(left, ",") != "{{a}},{{ b }}" {
+		t.Errorf("unexpected unresolved: %v", left)
+	}
+}
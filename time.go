@@ -53,7 +53,7 @@ func PrevDayStart(dt time.Time) time.Time {
 }
 
 // WeekStart - return time rounded to current week start
-// Assumes first week day is Sunday
+// Assumes first week day is Monday (as in ISO weeks)
 func WeekStart(dt time.Time) time.Time {
 	wDay := int(dt.Weekday())
 	// Go returns negative numbers for `modulo` operation when argument is negative
@@ -62,6 +62,31 @@ func WeekStart(dt time.Time) time.Time {
 	return DayStart(dt).AddDate(0, 0, -subDays)
 }
 
+// DayStartIn - return time rounded to current day start in loc
+// Unlike DayStart it returns time in loc, so it honours DST transitions of loc
+func DayStartIn(dt time.Time, loc *time.Location) time.Time {
+	dt = dt.In(loc)
+	return time.Date(
+		dt.Year(),
+		dt.Month(),
+		dt.Day(),
+		0,
+		0,
+		0,
+		0,
+		loc,
+	)
+}
+
+// WeekStartIn - return time rounded to current week start in loc, for weeks starting on first week day
+func WeekStartIn(dt time.Time, first time.Weekday, loc *time.Location) time.Time {
+	wDay := int(dt.In(loc).Weekday())
+	// Go returns negative numbers for `modulo` operation when argument is negative
+	// So instead of wDay-first I'm using wDay+7-first
+	subDays := (wDay + 7 - int(first)) % 7
+	return DayStartIn(dt, loc).AddDate(0, 0, -subDays)
+}
+
 // MonthStart - return time rounded to current month start
 func MonthStart(dt time.Time) time.Time {
 	return time.Date(
@@ -110,7 +135,22 @@ func ToYMDHMS(dt time.Time) string {
 	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second())
 }
 
+// ToYMD - return time formatted as YYYY-MM-DD
+func ToYMD(dt time.Time) string {
+	return fmt.Sprintf("%04d-%02d-%02d", dt.Year(), dt.Month(), dt.Day())
+}
+
 // ToYMDQuoted - return time formatted as 'YYYY-MM-DD'
 func ToYMDQuoted(dt time.Time) string {
 	return fmt.Sprintf("'%04d-%02d-%02d'", dt.Year(), dt.Month(), dt.Day())
 }
+
+// DateOf - return dt's calendar date as UTC midnight, this is how dates are stored and compared
+func DateOf(dt time.Time) time.Time {
+	return time.Date(dt.Year(), dt.Month(), dt.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// DaysBetween - return number of calendar days between from and to, ignoring DST changes in between
+func DaysBetween(from, to time.Time) int {
+	return int(DateOf(to).Sub(DateOf(from)).Hours() / 24)
+}
@@ -0,0 +1,49 @@
+package calcmetric
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartsKeepUTC(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	dt := time.Date(2026, 8, 19, 1, 2, 3, 0, loc)
+	for name, got := range map[string]time.Time{
+		"DayStart":     DayStart(dt),
+		"WeekStart":    WeekStart(dt),
+		"MonthStart":   MonthStart(dt),
+		"QuarterStart": QuarterStart(dt),
+		"YearStart":    YearStart(dt),
+	} {
+		if got.Location() != time.UTC {
+			t.Errorf("%s: expected UTC, got %v", name, got)
+		}
+	}
+	if got := DayStart(dt); !got.Equal(time.Date(2026, 8, 19, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("DayStart: got %v", got)
+	}
+}
+
+func TestStartsIn(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// 2026-08-18 20:00 UTC is already Wednesday 2026-08-19 in Tokyo
+	dt := time.Date(2026, 8, 18, 20, 0, 0, 0, time.UTC)
+	if got, expected := DayStartIn(dt, loc), time.Date(2026, 8, 19, 0, 0, 0, 0, loc); !got.Equal(expected) || got.Location() != loc {
+		t.Errorf("DayStartIn: expected %v, got %v", expected, got)
+	}
+	if got, expected := WeekStartIn(dt, time.Monday, loc), time.Date(2026, 8, 17, 0, 0, 0, 0, loc); !got.Equal(expected) {
+		t.Errorf("WeekStartIn monday: expected %v, got %v", expected, got)
+	}
+	if got, expected := WeekStartIn(dt, time.Sunday, loc), time.Date(2026, 8, 16, 0, 0, 0, 0, loc); !got.Equal(expected) {
+		t.Errorf("WeekStartIn sunday: expected %v, got %v", expected, got)
+	}
+	if got, expected := WeekStartIn(dt, time.Wednesday, loc), time.Date(2026, 8, 19, 0, 0, 0, 0, loc); !got.Equal(expected) {
+		t.Errorf("WeekStartIn wednesday: expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,68 @@
+package calcmetric
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// TimeoutExitCode - exit code used by calcmetric (and sync) when calculation exceeded its deadline or statement timeout
+const TimeoutExitCode = 124
+
+// ErrTimeout - calculation exceeded V3_TIMEOUT deadline or V3_STATEMENT_TIMEOUT, check with IsTimeout
+var ErrTimeout = errors.New("timeout")
+
+// IsTimeout - returns true if err means that calculation timed out (deadline exceeded or Postgres statement timeout)
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Name() == "query_canceled" && strings.Contains(pqErr.Message, "statement timeout")
+	}
+	return false
+}
+
+// timeoutError - returns err marked as timeout if it was caused by ctx deadline or statement timeout
+func timeoutError(ctx context.Context, err error, c *Calculation) error {
+	if err == nil || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: deadline exceeded: %v", ErrTimeout, err)
+	}
+	if IsTimeout(err) {
+		return fmt.Errorf("%w: statement timeout %v exceeded: %v", ErrTimeout, c.StatementTimeout, err)
+	}
+	return err
+}
+
+// setSession - applies transaction local settings: time zone (when tz is set) and statement timeout
+func setSession(ctx context.Context, tx *sql.Tx, c *Calculation, res *Result, tz bool) error {
+	settings := []string{}
+	if tz && c.TimeZone != "" {
+		settings = append(settings, "set local time zone "+pq.QuoteLiteral(res.TimeZone))
+	}
+	if c.StatementTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("set local statement_timeout = %d", c.StatementTimeout.Milliseconds()))
+	}
+	for _, setting := range settings {
+		if c.Debug {
+			Logf("%s\n", setting)
+		}
+		_, err := tx.ExecContext(ctx, setting)
+		if err != nil {
+			QueryOut(setting, []interface{}{}...)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package calcmetric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTimeout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "statement timeout", err: &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, expected: true},
+		{name: "wrapped statement timeout", err: fmt.Errorf("query: %w", &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}), expected: true},
+		{name: "user cancel", err: &pq.Error{Code: "57014", Message: "canceling statement due to user request"}, expected: false},
+		{name: "lock timeout", err: &pq.Error{Code: "55P03", Message: "canceling statement due to lock timeout"}, expected: false},
+		{name: "other error", err: &pq.Error{Code: "42601", Message: "syntax error at or near \"statement timeout\""}, expected: false},
+		{name: "deadline", err: context.DeadlineExceeded, expected: true},
+		{name: "wrapped deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), expected: true},
+		{name: "timeout", err: ErrTimeout, expected: true},
+		{name: "wrapped timeout", err: fmt.Errorf("%w: deadline exceeded", ErrTimeout), expected: true},
+		{name: "cancelled", err: context.Canceled, expected: false},
+		{name: "wrapped cancelled", err: fmt.Errorf("query: %w", context.Canceled), expected: false},
+		{name: "plain", err: errors.New("timeout"), expected: false},
+	}
+	for _, tc := range testCases {
+		got := IsTimeout(tc.err)
+		if got != tc.expected {
+			t.Errorf("%s: expected %v, got %v for: %v", tc.name, tc.expected, got, tc.err)
+		}
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	c := &Calculation{StatementTimeout: 30 * time.Second}
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	cancelled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	statementTimeout := &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}
+	userCancel := &pq.Error{Code: "57014", Message: "canceling statement due to user request"}
+	testCases := []struct {
+		name    string
+		ctx     context.Context
+		err     error
+		timeout bool
+		message string
+	}{
+		{name: "nil", ctx: context.Background(), err: nil},
+		{name: "deadline", ctx: context.Background(), err: context.DeadlineExceeded, timeout: true, message: "timeout: deadline exceeded: context deadline exceeded"},
+		{name: "ctx deadline", ctx: expired, err: userCancel, timeout: true, message: "timeout: deadline exceeded: pq: canceling statement due to user request"},
+		{name: "statement timeout", ctx: context.Background(), err: statementTimeout, timeout: true, message: "timeout: statement timeout 30s exceeded: pq: canceling statement due to statement timeout"},
+		{name: "already timeout", ctx: expired, err: fmt.Errorf("%w: x", ErrTimeout), timeout: true, message: "timeout: x"},
+		{name: "user cancel", ctx: context.Background(), err: userCancel, message: "pq: canceling statement due to user request"},
+		{name: "cancelled", ctx: cancelled, err: context.Canceled, message: "context canceled"},
+		{name: "cancelled query", ctx: cancelled, err: userCancel, message: "pq: canceling statement due to user request"},
+		{name: "other", ctx: context.Background(), err: errors.New("failed"), message: "failed"},
+	}
+	for _, tc := range testCases {
+		err := timeoutError(tc.ctx, tc.err, c)
+		if tc.err == nil {
+			if err != nil {
+				t.Errorf("%s: expected nil, got %v", tc.name, err)
+			}
+			continue
+		}
+		if IsTimeout(err) != tc.timeout || errors.Is(err, ErrTimeout) != tc.timeout {
+			t.Errorf("%s: expected timeout %v, got %v", tc.name, tc.timeout, err)
+		}
+		if err.Error() != tc.message {
+			t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.message, err.Error())
+		}
+		if !tc.timeout && err != tc.err {
+			t.Errorf("%s: expected unchanged error, got %v", tc.name, err)
+		}
+	}
+}
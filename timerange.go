@@ -0,0 +1,313 @@
+package calcmetric
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time range expressions:
+// Nu       - rolling N units ending today, for example 14d, 90d, 6m, 3y
+// last:Nu  - last N complete calendar units, for example last:2w, last:1q, months, quarters and years
+// are aligned to multiples of N, so last:6m is the previous half-year
+// wtd, mtd, qtd, ytd - from the current week/month/quarter/year start till today
+// isoweek  - last complete ISO week (Mon-Sun), isoweek-p is the ISO week before it
+// Weeks start on V3_WEEK_START day (Monday by default), ISO weeks always start on Monday
+// Quarters and years start on V3_FISCAL_YEAR_START month (January by default), months are always calendar months
+// all      - all time (1970-01-01 - 2100-01-01)
+// prev(X)  - time range of the same length directly before X, can be nested
+// Units: d - day, w - week, m - month, q - quarter, y - year
+const (
+	rangeRolling = "rolling"
+	rangeLast    = "last"
+	rangeToDate  = "todate"
+	rangeAll     = "all"
+	rangeISOWeek = "isoweek"
+)
+
+// gMaxTimeRangeLen - size of result tables' time_range column
+const gMaxTimeRangeLen = 64
+
+var (
+	gRangeUnitRe = regexp.MustCompile(`^([1-9][0-9]*)([dwmqy])$`)
+	// Maximum N of Nu and last:Nu expressions, 200 years in each unit, longer windows cannot fit between 1970 and 2100 anyway
+	gMaxRangeUnits = map[byte]int{'d': 73050, 'w': 10436, 'm': 2400, 'q': 800, 'y': 200}
+)
+
+// calendar - week and year boundaries used for time ranges computation
+type calendar struct {
+	weekStart time.Weekday
+	yearStart time.Month
+}
+
+// rangeExpr - parsed time range expression
+type rangeExpr struct {
+	kind string
+	n    int
+	unit byte
+	prev int // number of prev(...) applied
+}
+
+// legacyTimeRange - returns time range expression for time range codes used before the expressions were introduced
+// daily variants are used when V3_CALC_*_DAILY is set for that code, returns "" if timeRange is not a legacy code
+// legacy codes are also resolved inside prev(), so prev(q) is prev(last:1q) and prev(7dp) is prev(prev(last:1w))
+func legacyTimeRange(timeRange string, c *Calculation) string {
+	s := strings.TrimSpace(timeRange)
+	if strings.HasPrefix(s, "prev(") && strings.HasSuffix(s, ")") {
+		expr := legacyTimeRange(s[5:len(s)-1], c)
+		if expr == "" {
+			return ""
+		}
+		return "prev(" + expr + ")"
+	}
+	base := timeRange
+	prev := false
+	switch timeRange {
+	case "7dp", "30dp", "qp", "typ", "yp", "2yp":
+		base = timeRange[:len(timeRange)-1]
+		prev = true
+	}
+	expr := ""
+	switch base {
+	case "7d":
+		expr = "last:1w"
+		if c.CalcWeekDaily {
+			expr = "last:7d"
+		}
+	case "30d":
+		expr = "last:1m"
+		if c.CalcMonthDaily {
+			expr = "last:30d"
+		}
+	case "q":
+		expr = "last:1q"
+		if c.CalcQuarterDaily {
+			expr = "3m"
+		}
+	case "ty":
+		expr = "ytd"
+	case "y":
+		expr = "last:1y"
+		if c.CalcYearDaily {
+			expr = "1y"
+		}
+	case "2y":
+		expr = "last:2y"
+		if c.CalcYear2Daily {
+			expr = "2y"
+		}
+	case "a":
+		if !prev {
+			expr = "all"
+		}
+	}
+	if prev && expr != "" {
+		expr = "prev(" + expr + ")"
+	}
+	return expr
+}
+
+// parseTimeRange - parses time range expression
+func parseTimeRange(expr string) (rangeExpr, error) {
+	var r rangeExpr
+	if len(expr) > gMaxTimeRangeLen {
+		return r, fmt.Errorf("time range '%s' is longer than %d characters", expr, gMaxTimeRangeLen)
+	}
+	s := strings.TrimSpace(expr)
+	for strings.HasPrefix(s, "prev(") && strings.HasSuffix(s, ")") {
+		s = strings.TrimSpace(s[5 : len(s)-1])
+		r.prev++
+	}
+	switch s {
+	case "all":
+		r.kind = rangeAll
+		if r.prev > 0 {
+			return r, fmt.Errorf("time range '%s': there is no time range before all time", expr)
+		}
+		return r, nil
+	case "isoweek", "isoweek-p":
+		r.kind, r.n, r.unit = rangeISOWeek, 1, 'w'
+		if s == "isoweek-p" {
+			r.prev++
+		}
+		return r, nil
+	case "wtd", "mtd", "qtd", "ytd":
+		r.kind, r.n, r.unit = rangeToDate, 1, s[0]
+		return r, nil
+	}
+	r.kind = rangeRolling
+	if strings.HasPrefix(s, "last:") {
+		r.kind = rangeLast
+		s = s[5:]
+	}
+	m := gRangeUnitRe.FindStringSubmatch(s)
+	if m == nil {
+		return r, fmt.Errorf("unknown time range: '%s'", expr)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return r, fmt.Errorf("time range '%s': invalid number of units: %+v", expr, err)
+	}
+	r.n, r.unit = n, m[2][0]
+	if r.n > gMaxRangeUnits[r.unit] {
+		return r, fmt.Errorf("time range '%s': %d%c is longer than 200 years, maximum is %d%c", expr, r.n, r.unit, gMaxRangeUnits[r.unit], r.unit)
+	}
+	return r, nil
+}
+
+// addUnits - adds n units to dt
+func addUnits(dt time.Time, n int, unit byte) time.Time {
+	switch unit {
+	case 'd':
+		return dt.AddDate(0, 0, n)
+	case 'w':
+		return dt.AddDate(0, 0, 7*n)
+	case 'm':
+		return dt.AddDate(0, n, 0)
+	case 'q':
+		return dt.AddDate(0, 3*n, 0)
+	default:
+		return dt.AddDate(n, 0, 0)
+	}
+}
+
+// unitStart - returns start of the unit containing dt, months, quarters and years are aligned to multiples of n units
+// quarters and years start on cal.yearStart month
+func unitStart(dt time.Time, n int, unit byte, cal calendar) time.Time {
+	months := 0
+	offset := int(cal.yearStart) - 1
+	switch unit {
+	case 'd':
+		return DayStartIn(dt, dt.Location())
+	case 'w':
+		return WeekStartIn(dt, cal.weekStart, dt.Location())
+	case 'm':
+		months = n
+		offset = 0
+	case 'q':
+		months = 3 * n
+	default:
+		months = 12 * n
+	}
+	idx := dt.Year()*12 + int(dt.Month()) - 1 - offset
+	idx -= idx % months
+	idx += offset
+	return time.Date(idx/12, time.Month(idx%12+1), 1, 0, 0, 0, 0, dt.Location())
+}
+
+// computeTimeRange - returns time range for an expression at now, in now's location
+func computeTimeRange(r rangeExpr, now time.Time, cal calendar) (time.Time, time.Time) {
+	var dtf, dtt time.Time
+	switch r.kind {
+	case rangeAll:
+		dtt, _ = TimeParseAny("2100")
+		dtf, _ = TimeParseAny("1970")
+		return dtf, dtt
+	case rangeRolling:
+		dtt = DayStartIn(now, now.Location())
+		dtf = addUnits(dtt, -r.n, r.unit)
+	case rangeLast:
+		dtt = unitStart(now, r.n, r.unit, cal)
+		dtf = addUnits(dtt, -r.n, r.unit)
+	case rangeISOWeek:
+		dtt = WeekStartIn(now, time.Monday, now.Location())
+		dtf = addUnits(dtt, -1, 'w')
+	case rangeToDate:
+		dtt = DayStartIn(now, now.Location())
+		dtf = unitStart(now, 1, r.unit, cal)
+	}
+	for i := 0; i < r.prev; i++ {
+		if r.kind == rangeToDate {
+			days := DaysBetween(dtf, dtt)
+			dtf = dtf.AddDate(0, 0, -days)
+			dtt = dtt.AddDate(0, 0, -days)
+			continue
+		}
+		dtf = addUnits(dtf, -r.n, r.unit)
+		dtt = addUnits(dtt, -r.n, r.unit)
+	}
+	return dtf, dtt
+}
+
+// currentTimeRange - returns time range for now, now's location is used for all calendar computations
+// returned dates are calendar dates (UTC midnights)
+func currentTimeRange(c *Calculation, now time.Time) (time.Time, time.Time, error) {
+	r, expr, err := timeRangeExpr(c)
+	if err != nil {
+		return now, now, err
+	}
+	cal, err := c.calendar()
+	if err != nil {
+		return now, now, err
+	}
+	dtf, dtt := computeTimeRange(r, now, cal)
+	dtf, dtt = DateOf(dtf), DateOf(dtt)
+	Logf("checking for time range %s (%s) %s - %s (%s)\n", c.TimeRange, expr, ToYMDQuoted(dtf), ToYMDQuoted(dtt), now.Location())
+	return dtf, dtt, nil
+}
+
+// timeRangeExpr - returns parsed c.TimeRange and the expression it was parsed from (legacy codes are resolved)
+func timeRangeExpr(c *Calculation) (rangeExpr, string, error) {
+	expr := legacyTimeRange(c.TimeRange, c)
+	if expr == "" {
+		expr = c.TimeRange
+	}
+	r, err := parseTimeRange(expr)
+	return r, expr, err
+}
+
+// isFiscalRange - returns true if c.TimeRange at now differs from the calendar one because of fiscal year start
+// rows of such calculations have fiscal column set, so they can coexist with calendar ones
+func isFiscalRange(c *Calculation, now time.Time) bool {
+	r, _, err := timeRangeExpr(c)
+	if err != nil {
+		return false
+	}
+	cal, err := c.calendar()
+	if err != nil || cal.yearStart == time.January {
+		return false
+	}
+	dtf, dtt := computeTimeRange(r, now, cal)
+	cal.yearStart = time.January
+	calDtf, calDtt := computeTimeRange(r, now, cal)
+	return !dtf.Equal(calDtf) || !dtt.Equal(calDtt)
+}
+
+// isISOWeekRange - returns true if time range is an ISO week, such rows have iso_year and iso_week columns set
+func isISOWeekRange(timeRange string) bool {
+	r, err := parseTimeRange(timeRange)
+	return err == nil && r.kind == rangeISOWeek
+}
+
+// TimeRangeDays - returns number of days of c's time range at now (only up to now, future days have no data),
+// sync uses it to estimate calculation cost of tasks it has no history for
+func TimeRangeDays(c Calculation, now time.Time) (int, error) {
+	var dtf, dtt time.Time
+	if c.TimeRange == "c" {
+		var err error
+		dtf, err = TimeParseAny(c.DateFrom)
+		if err != nil {
+			return 0, err
+		}
+		dtt, err = TimeParseAny(c.DateTo)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		r, _, err := timeRangeExpr(&c)
+		if err != nil {
+			return 0, err
+		}
+		cal, err := c.calendar()
+		if err != nil {
+			return 0, err
+		}
+		dtf, dtt = computeTimeRange(r, now, cal)
+	}
+	if dtt.After(now) {
+		dtt = now
+	}
+	return DaysBetween(dtf, dtt), nil
+}
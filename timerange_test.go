@@ -0,0 +1,153 @@
+package calcmetric
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentTimeRange(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	newYork, _ := time.LoadLocation("America/New_York")
+	// Wednesday
+	wed := time.Date(2026, 8, 19, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name string
+		c    Calculation
+		now  time.Time
+		from string
+		to   string
+	}{
+		// Legacy codes
+		{name: "7d", c: Calculation{TimeRange: "7d"}, now: wed, from: "2026-08-10", to: "2026-08-17"},
+		{name: "7dp", c: Calculation{TimeRange: "7dp"}, now: wed, from: "2026-08-03", to: "2026-08-10"},
+		{name: "30d", c: Calculation{TimeRange: "30d"}, now: wed, from: "2026-07-01", to: "2026-08-01"},
+		{name: "30dp", c: Calculation{TimeRange: "30dp"}, now: wed, from: "2026-06-01", to: "2026-07-01"},
+		{name: "q", c: Calculation{TimeRange: "q"}, now: wed, from: "2026-04-01", to: "2026-07-01"},
+		{name: "qp", c: Calculation{TimeRange: "qp"}, now: wed, from: "2026-01-01", to: "2026-04-01"},
+		{name: "ty", c: Calculation{TimeRange: "ty"}, now: wed, from: "2026-01-01", to: "2026-08-19"},
+		{name: "typ", c: Calculation{TimeRange: "typ"}, now: wed, from: "2025-05-16", to: "2026-01-01"},
+		{name: "y", c: Calculation{TimeRange: "y"}, now: wed, from: "2025-01-01", to: "2026-01-01"},
+		{name: "yp", c: Calculation{TimeRange: "yp"}, now: wed, from: "2024-01-01", to: "2025-01-01"},
+		{name: "2y", c: Calculation{TimeRange: "2y"}, now: wed, from: "2024-01-01", to: "2026-01-01"},
+		{name: "2yp", c: Calculation{TimeRange: "2yp"}, now: wed, from: "2022-01-01", to: "2024-01-01"},
+		{name: "a", c: Calculation{TimeRange: "a"}, now: wed, from: "1970-01-01", to: "2100-01-01"},
+		// Daily variants of legacy codes
+		{name: "7d daily", c: Calculation{TimeRange: "7d", CalcWeekDaily: true}, now: wed, from: "2026-08-12", to: "2026-08-19"},
+		{name: "7dp daily", c: Calculation{TimeRange: "7dp", CalcWeekDaily: true}, now: wed, from: "2026-08-05", to: "2026-08-12"},
+		{name: "30d daily", c: Calculation{TimeRange: "30d", CalcMonthDaily: true}, now: wed, from: "2026-07-20", to: "2026-08-19"},
+		{name: "30dp daily", c: Calculation{TimeRange: "30dp", CalcMonthDaily: true}, now: wed, from: "2026-06-20", to: "2026-07-20"},
+		{name: "q daily", c: Calculation{TimeRange: "q", CalcQuarterDaily: true}, now: wed, from: "2026-05-19", to: "2026-08-19"},
+		{name: "qp daily", c: Calculation{TimeRange: "qp", CalcQuarterDaily: true}, now: wed, from: "2026-02-19", to: "2026-05-19"},
+		{name: "y daily", c: Calculation{TimeRange: "y", CalcYearDaily: true}, now: wed, from: "2025-08-19", to: "2026-08-19"},
+		{name: "yp daily", c: Calculation{TimeRange: "yp", CalcYearDaily: true}, now: wed, from: "2024-08-19", to: "2025-08-19"},
+		{name: "2y daily", c: Calculation{TimeRange: "2y", CalcYear2Daily: true}, now: wed, from: "2024-08-19", to: "2026-08-19"},
+		{name: "2yp daily", c: Calculation{TimeRange: "2yp", CalcYear2Daily: true}, now: wed, from: "2022-08-19", to: "2024-08-19"},
+		// Legacy codes inside prev()
+		{name: "prev(q)", c: Calculation{TimeRange: "prev(q)"}, now: wed, from: "2026-01-01", to: "2026-04-01"},
+		{name: "prev(prev(7d))", c: Calculation{TimeRange: "prev(prev(7d))"}, now: wed, from: "2026-07-27", to: "2026-08-03"},
+		{name: "prev(7dp)", c: Calculation{TimeRange: "prev(7dp)"}, now: wed, from: "2026-07-27", to: "2026-08-03"},
+		{name: "prev(30d) daily", c: Calculation{TimeRange: "prev(30d)", CalcMonthDaily: true}, now: wed, from: "2026-06-20", to: "2026-07-20"},
+		// Expressions
+		{name: "14d", c: Calculation{TimeRange: "14d"}, now: wed, from: "2026-08-05", to: "2026-08-19"},
+		{name: "last:6m", c: Calculation{TimeRange: "last:6m"}, now: wed, from: "2026-01-01", to: "2026-07-01"},
+		{name: "mtd", c: Calculation{TimeRange: "mtd"}, now: wed, from: "2026-08-01", to: "2026-08-19"},
+		{name: "prev(mtd)", c: Calculation{TimeRange: "prev(mtd)"}, now: wed, from: "2026-07-14", to: "2026-08-01"},
+		{name: "isoweek", c: Calculation{TimeRange: "isoweek"}, now: wed, from: "2026-08-10", to: "2026-08-17"},
+		{name: "isoweek-p", c: Calculation{TimeRange: "isoweek-p"}, now: wed, from: "2026-08-03", to: "2026-08-10"},
+		// Fiscal years starting in February and July
+		{name: "q fiscal feb", c: Calculation{TimeRange: "q", FiscalYearStart: "feb"}, now: wed, from: "2026-05-01", to: "2026-08-01"},
+		{name: "qp fiscal feb", c: Calculation{TimeRange: "qp", FiscalYearStart: "2"}, now: wed, from: "2026-02-01", to: "2026-05-01"},
+		{name: "y fiscal feb", c: Calculation{TimeRange: "y", FiscalYearStart: "february"}, now: wed, from: "2025-02-01", to: "2026-02-01"},
+		{name: "y fiscal jul", c: Calculation{TimeRange: "y", FiscalYearStart: "7"}, now: wed, from: "2025-07-01", to: "2026-07-01"},
+		{name: "ty fiscal jul", c: Calculation{TimeRange: "ty", FiscalYearStart: "jul"}, now: wed, from: "2026-07-01", to: "2026-08-19"},
+		{name: "2y fiscal jul", c: Calculation{TimeRange: "2y", FiscalYearStart: "jul"}, now: wed, from: "2024-07-01", to: "2026-07-01"},
+		{name: "30d fiscal jul", c: Calculation{TimeRange: "30d", FiscalYearStart: "jul"}, now: wed, from: "2026-07-01", to: "2026-08-01"},
+		{name: "y daily fiscal jul", c: Calculation{TimeRange: "y", CalcYearDaily: true, FiscalYearStart: "jul"}, now: wed, from: "2025-08-19", to: "2026-08-19"},
+		// Weeks starting on Sunday and Saturday, ISO weeks always start on Monday
+		{name: "7d sunday", c: Calculation{TimeRange: "7d", WeekStart: "sunday"}, now: wed, from: "2026-08-09", to: "2026-08-16"},
+		{name: "7dp sunday", c: Calculation{TimeRange: "7dp", WeekStart: "sun"}, now: wed, from: "2026-08-02", to: "2026-08-09"},
+		{name: "7d saturday", c: Calculation{TimeRange: "7d", WeekStart: "sat"}, now: wed, from: "2026-08-08", to: "2026-08-15"},
+		{name: "wtd sunday", c: Calculation{TimeRange: "wtd", WeekStart: "sunday"}, now: wed, from: "2026-08-16", to: "2026-08-19"},
+		{name: "isoweek sunday", c: Calculation{TimeRange: "isoweek", WeekStart: "sunday"}, now: wed, from: "2026-08-10", to: "2026-08-17"},
+		// Time zones: local dates differ from UTC dates
+		{name: "1d tokyo", c: Calculation{TimeRange: "1d"}, now: time.Date(2026, 10, 18, 0, 30, 0, 0, tokyo), from: "2026-10-17", to: "2026-10-18"},
+		{name: "1d new york", c: Calculation{TimeRange: "1d"}, now: time.Date(2026, 10, 17, 22, 0, 0, 0, newYork), from: "2026-10-16", to: "2026-10-17"},
+		// DST: autumn change (2026-10-25) and spring change (2026-03-29) in Warsaw, shortly after local midnight
+		{name: "1d dst autumn", c: Calculation{TimeRange: "1d"}, now: time.Date(2026, 10, 26, 0, 30, 0, 0, warsaw), from: "2026-10-25", to: "2026-10-26"},
+		{name: "7d dst autumn", c: Calculation{TimeRange: "7d"}, now: time.Date(2026, 10, 26, 0, 30, 0, 0, warsaw), from: "2026-10-19", to: "2026-10-26"},
+		{name: "7d daily dst autumn", c: Calculation{TimeRange: "7d", CalcWeekDaily: true}, now: time.Date(2026, 10, 26, 0, 30, 0, 0, warsaw), from: "2026-10-19", to: "2026-10-26"},
+		{name: "30d dst autumn", c: Calculation{TimeRange: "30d"}, now: time.Date(2026, 11, 1, 0, 30, 0, 0, warsaw), from: "2026-10-01", to: "2026-11-01"},
+		{name: "1d dst spring", c: Calculation{TimeRange: "1d"}, now: time.Date(2026, 3, 30, 0, 15, 0, 0, warsaw), from: "2026-03-29", to: "2026-03-30"},
+		{name: "7d dst spring", c: Calculation{TimeRange: "7d"}, now: time.Date(2026, 3, 30, 0, 15, 0, 0, warsaw), from: "2026-03-23", to: "2026-03-30"},
+		{name: "prev(7d) dst spring", c: Calculation{TimeRange: "prev(7d)"}, now: time.Date(2026, 4, 6, 0, 15, 0, 0, warsaw), from: "2026-03-23", to: "2026-03-30"},
+	}
+	for _, tc := range testCases {
+		dtf, dtt, err := currentTimeRange(&tc.c, tc.now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if ToYMD(dtf) != tc.from || ToYMD(dtt) != tc.to {
+			t.Errorf("%s: expected %s - %s, got %s - %s", tc.name, tc.from, tc.to, ToYMD(dtf), ToYMD(dtt))
+		}
+		if dtf.Location() != time.UTC || dtt.Location() != time.UTC {
+			t.Errorf("%s: expected UTC dates, got %v - %v", tc.name, dtf, dtt)
+		}
+	}
+}
+
+func TestTimeRangeErrors(t *testing.T) {
+	for _, timeRange := range []string{"prev(a)", "prev(all)", "x", "0d", "last:2x", "prev(x)", "prev(7d", "c", "99999999999999999999d", "last:4611686018427387904y", "last:99999999999999999999m", "73051d", "last:201y", "prev(801q)"} {
+		c := Calculation{TimeRange: timeRange}
+		_, _, err := currentTimeRange(&c, time.Now())
+		if err == nil {
+			t.Errorf("%s: expected error", timeRange)
+		}
+	}
+	for _, c := range []Calculation{{TimeRange: "7d", WeekStart: "someday"}, {TimeRange: "q", FiscalYearStart: "13"}} {
+		_, _, err := currentTimeRange(&c, time.Now())
+		if err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestTimeRangeMaxUnits(t *testing.T) {
+	now := time.Date(2026, 8, 19, 10, 0, 0, 0, time.UTC)
+	for _, timeRange := range []string{"73050d", "10436w", "last:2400m", "last:800q", "200y", "last:200y"} {
+		c := Calculation{TimeRange: timeRange}
+		dtf, dtt, err := currentTimeRange(&c, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", timeRange, err)
+			continue
+		}
+		if !dtf.Before(dtt) {
+			t.Errorf("%s: expected date from before date to, got %v - %v", timeRange, dtf, dtt)
+		}
+	}
+}
+
+func TestIsFiscalRange(t *testing.T) {
+	wed := time.Date(2026, 8, 19, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		c        Calculation
+		expected bool
+	}{
+		{Calculation{TimeRange: "y"}, false},
+		{Calculation{TimeRange: "y", FiscalYearStart: "jul"}, true},
+		{Calculation{TimeRange: "q", FiscalYearStart: "jul"}, false},
+		{Calculation{TimeRange: "q", FiscalYearStart: "feb"}, true},
+		{Calculation{TimeRange: "30d", FiscalYearStart: "feb"}, false},
+		{Calculation{TimeRange: "y", CalcYearDaily: true, FiscalYearStart: "jul"}, false},
+	}
+	for _, tc := range testCases {
+		got := isFiscalRange(&tc.c, wed)
+		if got != tc.expected {
+			t.Errorf("%+v: expected %v, got %v", tc.c, tc.expected, got)
+		}
+	}
+}
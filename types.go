@@ -0,0 +1,177 @@
+package calcmetric
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// Postgres type names (as returned by the driver) mapped to result table column types
+	// Array types are returned with "_" prefix, they map to their element's type with "[]" suffix
+	gTypeMapping = map[string]string{
+		"text":        "text",
+		"varchar":     "text",
+		"bpchar":      "text",
+		"char":        "text",
+		"name":        "text",
+		"citext":      "text",
+		"bool":        "bool",
+		"int2":        "bigint",
+		"int4":        "bigint",
+		"int8":        "bigint",
+		"int16":       "bigint",
+		"int32":       "bigint",
+		"int64":       "bigint",
+		"oid":         "bigint",
+		"float4":      "numeric",
+		"float8":      "numeric",
+		"numeric":     "numeric",
+		"date":        "date",
+		"timestamp":   "timestamp",
+		"timestamptz": "timestamp",
+		"time":        "time",
+		"timetz":      "timetz",
+		"interval":    "interval",
+		"uuid":        "uuid",
+		"json":        "jsonb",
+		"jsonb":       "jsonb",
+		"inet":        "inet",
+		"cidr":        "cidr",
+		"macaddr":     "macaddr",
+		"xml":         "xml",
+	}
+	// Postgres types whose values cannot be loaded from their text form as returned by the driver, even when guessing types
+	// bytea is decoded into raw bytes by the driver and money text form (like $1,000.00) depends on lc_monetary
+	gUnsupportedTypes = map[string]string{
+		"bytea": "encode(column, 'hex')",
+		"money": "column::numeric",
+	}
+	// -- column: name type
+	gColumnHeaderRe = regexp.MustCompile(`^\s*--\s*column:\s*([A-Za-z_][A-Za-z0-9_]*)\s+(.+?)\s*$`)
+	// Allowed column type overrides: single word or known multi-word type name with optional (precision, scale) and
+	// optional [] suffix, nothing else (like constraints or generated columns) can be added to DDL
+	gColumnTypeRe = regexp.MustCompile(`^([a-z_][a-z0-9_]*|double precision|character varying|bit varying|(timestamp|time) with(out)? time zone)( ?\(\s*\d+\s*(,\s*\d+\s*)?\))?(\[\])?$`)
+)
+
+// dbTypeName - returns column type to use in the result table for a given metric SQL column
+// Explicit per-metric overrides (from types map) take precedence over the built-in mapping
+func dbTypeName(column *sql.ColumnType, types map[string]string, guess bool) (string, error) {
+	return mapTypeName(column.Name(), column.DatabaseTypeName(), types, guess)
+}
+
+// mapTypeName - returns result table column type for column of a given driver's database type name, see dbTypeName
+func mapTypeName(column, dbType string, types map[string]string, guess bool) (string, error) {
+	name := strings.ToLower(dbType)
+	cast, ok := gUnsupportedTypes[strings.TrimPrefix(name, "_")]
+	if ok {
+		return "error", fmt.Errorf("unsupported type: '%s' of column '%s', its values cannot be loaded as returned by the database, convert them in metric SQL, for example: %s", name, column, strings.Replace(cast, "column", column, -1))
+	}
+	tp, ok := types[strings.ToLower(column)]
+	if ok {
+		return tp, nil
+	}
+	tp, ok = gTypeMapping[name]
+	if ok {
+		return tp, nil
+	}
+	if strings.HasPrefix(name, "_") {
+		tp, ok = gTypeMapping[name[1:]]
+		if ok {
+			return tp + "[]", nil
+		}
+	}
+	if guess && name != "" {
+		return name, nil
+	}
+	return "error", fmt.Errorf("unknown type: '%s' of column '%s', you can specify it via %sCOLUMN_TYPES or '-- column: %s type' line in metric SQL", name, column, Prefix, column)
+}
+
+// checkColumnType - validates column type override, it is used in DDL directly so it cannot contain arbitrary SQL
+func checkColumnType(name, tp string) (string, error) {
+	tp = strings.Join(strings.Fields(strings.ToLower(tp)), " ")
+	if !gColumnTypeRe.MatchString(tp) {
+		return "", fmt.Errorf("invalid type '%s' specified for column '%s'", tp, name)
+	}
+	return tp, nil
+}
+
+// parseColumnTypes - parses "name:type,name2:type2" column types overrides
+func parseColumnTypes(spec string) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ary := strings.SplitN(item, ":", 2)
+		if len(ary) < 2 {
+			return nil, fmt.Errorf("invalid column type '%s', expected name:type", item)
+		}
+		name := strings.ToLower(strings.TrimSpace(ary[0]))
+		tp, err := checkColumnType(name, ary[1])
+		if err != nil {
+			return nil, err
+		}
+		types[name] = tp
+	}
+	return types, nil
+}
+
+// sqlColumnTypes - returns column types overrides specified as "-- column: name type" lines in metric SQL
+func sqlColumnTypes(tmpl string) (map[string]string, error) {
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(tmpl))
+	for scanner.Scan() {
+		m := gColumnHeaderRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		name := strings.ToLower(m[1])
+		tp, err := checkColumnType(name, m[2])
+		if err != nil {
+			return nil, err
+		}
+		types[name] = tp
+	}
+	return types, scanner.Err()
+}
+
+// columnTypes - returns final column types overrides, V3_COLUMN_TYPES values take precedence over metric SQL ones
+// which are "-- column: name type" lines and front-matter's column_types
+// Overrides of key and built-in columns (like iso_year or iso_week) fail before touching the database, see checkColumnNames
+func columnTypes(tmpl string, hdrTypes map[string]string, c *Calculation) (map[string]string, error) {
+	types, err := sqlColumnTypes(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	for name, tp := range hdrTypes {
+		name = strings.ToLower(name)
+		tp, err = checkColumnType(name, tp)
+		if err != nil {
+			return nil, err
+		}
+		types[name] = tp
+	}
+	for name, tp := range c.ColumnTypes {
+		name = strings.ToLower(name)
+		tp, err = checkColumnType(name, tp)
+		if err != nil {
+			return nil, err
+		}
+		types[name] = tp
+	}
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	err = checkColumnNames(c.Metric, names)
+	if err != nil {
+		return nil, err
+	}
+	return types, nil
+}
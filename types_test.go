@@ -0,0 +1,127 @@
+package calcmetric
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapTypeName(t *testing.T) {
+	types := map[string]string{"memberid": "uuid", "amount": "numeric"}
+	testCases := []struct {
+		column   string
+		dbType   string
+		guess    bool
+		expected string
+		err      string
+	}{
+		{column: "name", dbType: "VARCHAR", expected: "text"},
+		{column: "cnt", dbType: "INT4", expected: "bigint"},
+		{column: "ratio", dbType: "FLOAT8", expected: "numeric"},
+		{column: "ts", dbType: "TIMESTAMPTZ", expected: "timestamp"},
+		{column: "data", dbType: "JSON", expected: "jsonb"},
+		{column: "tags", dbType: "_TEXT", expected: "text[]"},
+		{column: "ids", dbType: "_INT4", expected: "bigint[]"},
+		{column: "memberid", dbType: "TEXT", expected: "uuid"},
+		{column: "MemberID", dbType: "", expected: "uuid"},
+		{column: "geo", dbType: "POINT", err: "unknown type: 'point' of column 'geo'"},
+		{column: "geo", dbType: "POINT", guess: true, expected: "point"},
+		{column: "geos", dbType: "_POINT", guess: true, expected: "_point"},
+		{column: "x", dbType: "", guess: true, err: "unknown type"},
+		{column: "avatar", dbType: "BYTEA", err: "encode(avatar, 'hex')"},
+		{column: "avatar", dbType: "BYTEA", guess: true, err: "unsupported type: 'bytea'"},
+		{column: "avatars", dbType: "_BYTEA", err: "unsupported type: '_bytea'"},
+		{column: "amount", dbType: "MONEY", err: "amount::numeric"},
+		{column: "amount", dbType: "MONEY", guess: true, err: "unsupported type: 'money'"},
+	}
+	for _, tc := range testCases {
+		got, err := mapTypeName(tc.column, tc.dbType, types, tc.guess)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s %s: expected error containing '%s', got: '%s', %v", tc.column, tc.dbType, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tc.column, tc.dbType, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%s %s: expected '%s', got '%s'", tc.column, tc.dbType, tc.expected, got)
+		}
+	}
+}
+
+func TestParseColumnTypes(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected map[string]string
+		err      string
+	}{
+		{spec: "", expected: map[string]string{}},
+		{spec: "MemberID:UUID, tags : text[] ,", expected: map[string]string{"memberid": "uuid", "tags": "text[]"}},
+		{spec: "b:numeric (5),c:varchar(64)[]", expected: map[string]string{"b": "numeric (5)", "c": "varchar(64)[]"}},
+		{spec: "a:double  precision,b:character varying(10)", expected: map[string]string{"a": "double precision", "b": "character varying(10)"}},
+		{spec: "a:timestamp with time zone,b:time without time zone", expected: map[string]string{"a": "timestamp with time zone", "b": "time without time zone"}},
+		{spec: "memberid", err: "expected name:type"},
+		{spec: "a:text references t", err: "invalid type 'text references t'"},
+		{spec: "a:bigint generated always as identity", err: "invalid type"},
+		{spec: "a:text not null", err: "invalid type"},
+		{spec: "a:text; drop table t", err: "invalid type"},
+		{spec: "a:text default 'x'", err: "invalid type"},
+		{spec: "a:numeric(10,2) check (a > 0)", err: "invalid type"},
+		{spec: "a:", err: "invalid type"},
+	}
+	for _, tc := range testCases {
+		got, err := parseColumnTypes(tc.spec)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("'%s': expected error containing '%s', got: %v, %v", tc.spec, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("'%s': expected %v, got %v", tc.spec, tc.expected, got)
+		}
+	}
+}
+
+func TestSQLColumnTypes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		tmpl     string
+		expected map[string]string
+		err      string
+	}{
+		{name: "none", tmpl: "select 1 as a", expected: map[string]string{}},
+		{
+			name:     "headers",
+			tmpl:     "-- column: MemberID uuid\n  --column:tags   text[]  \n-- other comment\nselect memberid, tags from t",
+			expected: map[string]string{"memberid": "uuid", "tags": "text[]"},
+		},
+		{name: "precision and scale", tmpl: "-- column: a numeric( 10 , 2 )\nselect 1 as a", expected: map[string]string{"a": "numeric( 10 , 2 )"}},
+		{name: "last wins", tmpl: "-- column: a text\n-- column: a bigint\nselect 1 as a", expected: map[string]string{"a": "bigint"}},
+		{name: "not a header", tmpl: "select 1 as a -- column: a uuid", expected: map[string]string{}},
+		{name: "invalid type", tmpl: "-- column: a text references t\nselect 1 as a", err: "invalid type 'text references t' specified for column 'a'"},
+	}
+	for _, tc := range testCases {
+		got, err := sqlColumnTypes(tc.tmpl)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing '%s', got: %v, %v", tc.name, tc.err, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}